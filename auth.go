@@ -0,0 +1,275 @@
+package main
+
+import (
+	"code.google.com/p/goauth2/oauth"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+// deviceCodeURL is the endpoint at which the device flow is started.
+const deviceCodeURL = "https://oauth2.googleapis.com/device/code"
+
+// A tokenError is an error response of the token endpoint.
+type tokenError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *tokenError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// requestToken sends a token request with the parameters v to the token
+// endpoint of conf, authenticating as its client.
+func requestToken(client *http.Client, conf *oauth.Config, v neturl.Values) (*oauth.Token, error) {
+	v.Set("client_id", conf.ClientId)
+	if conf.ClientSecret != "" {
+		v.Set("client_secret", conf.ClientSecret)
+	}
+	return postToken(client, conf.TokenURL, v)
+}
+
+// postToken sends a token request with the parameters v to the token endpoint
+// at url.
+func postToken(client *http.Client, url string, v neturl.Values) (*oauth.Token, error) {
+	resp, err := client.PostForm(url, v)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		tokenError
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		if resp.StatusCode >= 400 {
+			return nil, errors.New(resp.Status)
+		}
+		return nil, err
+	}
+	if body.Code != "" {
+		return nil, &body.tokenError
+	}
+	if resp.StatusCode >= 400 {
+		return nil, errors.New(resp.Status)
+	}
+	if body.AccessToken == "" {
+		return nil, errors.New("no access token in response")
+	}
+	tok := &oauth.Token{
+		AccessToken:  body.AccessToken,
+		RefreshToken: body.RefreshToken,
+	}
+	if body.ExpiresIn > 0 {
+		tok.Expiry = time.Now().Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	return tok, nil
+}
+
+// randomString returns a random URL-safe string of n bytes of entropy.
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// A loopbackFlow obtains a token by letting the browser redirect to a local
+// listener after the user has authorized drivefs. The code is protected by
+// PKCE, so that other local programs can't use it.
+type loopbackFlow struct {
+	conf    *oauth.Config
+	client  *http.Client
+	listen  string        // the address to listen on
+	timeout time.Duration // how long to wait for the user
+	// prompt asks the user to visit url.
+	prompt func(url string)
+}
+
+// newLoopbackFlow returns a loopbackFlow which uses the configuration of
+// transport and prints the URL to visit.
+func newLoopbackFlow() *loopbackFlow {
+	return &loopbackFlow{
+		conf:    transport.Config,
+		client:  &http.Client{Transport: transport.Transport},
+		listen:  "127.0.0.1:0",
+		timeout: 5 * time.Minute,
+		prompt: func(url string) {
+			fmt.Println("Visit this URL and log in with your Google account:")
+			fmt.Println(url)
+		},
+	}
+}
+
+// authURL returns the URL at which the user authorizes drivefs.
+func (f *loopbackFlow) authURL(redirect, state, verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	v := neturl.Values{
+		"response_type":         {"code"},
+		"client_id":             {f.conf.ClientId},
+		"redirect_uri":          {redirect},
+		"scope":                 {f.conf.Scope},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+		// Request a refresh token every time.
+		"access_type": {"offline"},
+		"prompt":      {"consent"},
+	}
+	sep := "?"
+	if strings.Contains(f.conf.AuthURL, "?") {
+		sep = "&"
+	}
+	return f.conf.AuthURL + sep + v.Encode()
+}
+
+// token runs the flow and returns the token.
+func (f *loopbackFlow) token() (*oauth.Token, error) {
+	l, err := net.Listen("tcp", f.listen)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	redirect := "http://" + l.Addr().String() + "/"
+	state, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if q.Get("state") != state {
+			http.Error(w, "Invalid state.", http.StatusBadRequest)
+			return
+		}
+		var r result
+		if e := q.Get("error"); e != "" {
+			r.err = &tokenError{Code: e, Description: q.Get("error_description")}
+			fmt.Fprintln(w, "Authorization failed:", r.err)
+		} else if r.code = q.Get("code"); r.code == "" {
+			http.Error(w, "Missing code.", http.StatusBadRequest)
+			return
+		} else {
+			fmt.Fprintln(w, "drivefs has been authorized. You can close this window.")
+		}
+		select {
+		case results <- r:
+		default:
+		}
+	})
+	go http.Serve(l, handler)
+
+	f.prompt(f.authURL(redirect, state, verifier))
+	var r result
+	select {
+	case r = <-results:
+	case <-time.After(f.timeout):
+		return nil, errors.New("timed out waiting for authorization")
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return requestToken(f.client, f.conf, neturl.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {r.code},
+		"redirect_uri":  {redirect},
+		"code_verifier": {verifier},
+	})
+}
+
+// A deviceFlow obtains a token by letting the user enter a code on another
+// device, for machines without a browser. Google only allows it for clients
+// of the type "TVs and Limited Input devices".
+type deviceFlow struct {
+	conf      *oauth.Config
+	client    *http.Client
+	deviceURL string
+	// prompt asks the user to enter code at url.
+	prompt func(code, url string)
+}
+
+func newDeviceFlow() *deviceFlow {
+	return &deviceFlow{
+		conf:      transport.Config,
+		client:    &http.Client{Transport: transport.Transport},
+		deviceURL: deviceCodeURL,
+		prompt: func(code, url string) {
+			fmt.Println("Visit this URL on any device, log in with your Google account and enter the code", code)
+			fmt.Println(url)
+		},
+	}
+}
+
+// token runs the flow and returns the token.
+func (f *deviceFlow) token() (*oauth.Token, error) {
+	resp, err := f.client.PostForm(f.deviceURL, neturl.Values{
+		"client_id": {f.conf.ClientId},
+		"scope":     {f.conf.Scope},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var dev struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURL string `json:"verification_url"`
+		ExpiresIn       int64  `json:"expires_in"`
+		Interval        int64  `json:"interval"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&dev)
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, errors.New(resp.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.prompt(dev.UserCode, dev.VerificationURL)
+	interval := time.Duration(dev.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(dev.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		tok, err := requestToken(f.client, f.conf, neturl.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {dev.DeviceCode},
+		})
+		if e, ok := err.(*tokenError); ok {
+			switch e.Code {
+			case "authorization_pending":
+				continue
+			case "slow_down":
+				interval += 5 * time.Second
+				continue
+			}
+		}
+		return tok, err
+	}
+	return nil, errors.New("the code has expired")
+}
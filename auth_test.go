@@ -0,0 +1,184 @@
+package main
+
+import (
+	"code.google.com/p/goauth2/oauth"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"testing"
+	"time"
+)
+
+// A fakeTokenServer is a token endpoint which issues a token for one code if
+// the PKCE verifier matches the challenge of the authorization request.
+type fakeTokenServer struct {
+	*httptest.Server
+	code      string
+	challenge string // set from the authorization URL
+	requests  int
+}
+
+func newFakeTokenServer(code string) *fakeTokenServer {
+	s := &fakeTokenServer{code: code}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *fakeTokenServer) serve(w http.ResponseWriter, req *http.Request) {
+	s.requests++
+	w.Header().Set("Content-Type", "application/json")
+	sum := sha256.Sum256([]byte(req.FormValue("code_verifier")))
+	switch {
+	case req.FormValue("grant_type") != "authorization_code" ||
+		req.FormValue("client_id") != "client":
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+	case req.FormValue("code") != s.code ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != s.challenge:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+	default:
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "access",
+			"refresh_token": "refresh",
+			"expires_in":    3600,
+		})
+	}
+}
+
+// testFlow returns a loopbackFlow against s in which the browser is replaced
+// by redirect, which is called with the parameters of the authorization URL.
+func testFlow(t *testing.T, s *fakeTokenServer, redirect func(auth neturl.Values)) *loopbackFlow {
+	return &loopbackFlow{
+		conf: &oauth.Config{
+			ClientId: "client",
+			Scope:    "scope",
+			AuthURL:  "https://auth.example.com/auth",
+			TokenURL: s.URL,
+		},
+		client:  http.DefaultClient,
+		listen:  "127.0.0.1:0",
+		timeout: 5 * time.Second,
+		prompt: func(url string) {
+			u, err := neturl.Parse(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth := u.Query()
+			if m := auth.Get("code_challenge_method"); m != "S256" {
+				t.Errorf("code_challenge_method = %q, want S256", m)
+			}
+			s.challenge = auth.Get("code_challenge")
+			redirect(auth)
+		},
+	}
+}
+
+// visit sends the browser to the redirect URI of auth with the parameters v and
+// returns the status of the response.
+func visit(t *testing.T, auth neturl.Values, v neturl.Values) int {
+	resp, err := http.Get(auth.Get("redirect_uri") + "?" + v.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestLoopbackFlow(t *testing.T) {
+	s := newFakeTokenServer("code")
+	defer s.Close()
+	f := testFlow(t, s, func(auth neturl.Values) {
+		if status := visit(t, auth, neturl.Values{"code": {"code"}, "state": {auth.Get("state")}}); status != http.StatusOK {
+			t.Errorf("redirect status = %d, want %d", status, http.StatusOK)
+		}
+	})
+	tok, err := f.token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "access" || tok.RefreshToken != "refresh" {
+		t.Errorf("got token %+v", tok)
+	}
+	if tok.Expiry.IsZero() {
+		t.Error("token has no expiry")
+	}
+}
+
+func TestLoopbackFlowState(t *testing.T) {
+	s := newFakeTokenServer("code")
+	defer s.Close()
+	f := testFlow(t, s, func(auth neturl.Values) {
+		// A redirect without the right state, e.g. from another site,
+		// must be ignored.
+		for _, state := range []string{"", "forged"} {
+			v := neturl.Values{"code": {"forged"}, "state": {state}}
+			if status := visit(t, auth, v); status != http.StatusBadRequest {
+				t.Errorf("redirect with state %q: status = %d, want %d", state, status, http.StatusBadRequest)
+			}
+		}
+		visit(t, auth, neturl.Values{"code": {"code"}, "state": {auth.Get("state")}})
+	})
+	if _, err := f.token(); err != nil {
+		t.Fatal(err)
+	}
+	if s.requests != 1 {
+		t.Errorf("%d token requests, want 1", s.requests)
+	}
+}
+
+func TestLoopbackFlowVerifier(t *testing.T) {
+	s := newFakeTokenServer("code")
+	defer s.Close()
+	f := testFlow(t, s, func(auth neturl.Values) {
+		// The challenge doesn't belong to the verifier of the flow.
+		s.challenge = "other"
+		visit(t, auth, neturl.Values{"code": {"code"}, "state": {auth.Get("state")}})
+	})
+	_, err := f.token()
+	if e, ok := err.(*tokenError); !ok || e.Code != "invalid_grant" {
+		t.Errorf("got error %v, want invalid_grant", err)
+	}
+}
+
+func TestLoopbackFlowDenied(t *testing.T) {
+	s := newFakeTokenServer("code")
+	defer s.Close()
+	f := testFlow(t, s, func(auth neturl.Values) {
+		visit(t, auth, neturl.Values{"error": {"access_denied"}, "state": {auth.Get("state")}})
+	})
+	_, err := f.token()
+	if e, ok := err.(*tokenError); !ok || e.Code != "access_denied" {
+		t.Errorf("got error %v, want access_denied", err)
+	}
+	if s.requests != 0 {
+		t.Errorf("%d token requests, want 0", s.requests)
+	}
+}
+
+func TestLoopbackFlowMissingCode(t *testing.T) {
+	s := newFakeTokenServer("code")
+	defer s.Close()
+	f := testFlow(t, s, func(auth neturl.Values) {
+		if status := visit(t, auth, neturl.Values{"state": {auth.Get("state")}}); status != http.StatusBadRequest {
+			t.Errorf("redirect status = %d, want %d", status, http.StatusBadRequest)
+		}
+	})
+	f.timeout = 100 * time.Millisecond
+	if _, err := f.token(); err == nil {
+		t.Error("got no error")
+	}
+}
+
+func TestLoopbackFlowTimeout(t *testing.T) {
+	s := newFakeTokenServer("code")
+	defer s.Close()
+	f := testFlow(t, s, func(auth neturl.Values) {})
+	f.timeout = 100 * time.Millisecond
+	if _, err := f.token(); err == nil {
+		t.Error("got no error")
+	}
+}
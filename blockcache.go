@@ -0,0 +1,185 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// blockSize is the size of the blocks in which file contents are downloaded
+// and cached.
+const blockSize = 1 << 20
+
+// blocks is the cache shared by all files. It is nil if caching is disabled.
+var blocks *blockCache
+
+type blockKey struct {
+	file  string
+	index int64
+}
+
+type cachedBlock struct {
+	key  blockKey
+	size int64
+}
+
+// A blockCache stores blocks of file contents on disk, evicting the least
+// recently used ones when its size exceeds the limit. Each cached version of a
+// file gets its own directory in which the blocks are stored by their index.
+type blockCache struct {
+	dir   string
+	limit int64
+	size  int64
+	lru   *list.List // of *cachedBlock, most recently used first
+	index map[blockKey]*list.Element
+	sync.Mutex
+}
+
+// cacheKey returns the key under which the blocks of the given version of a
+// file are stored.
+func cacheKey(id, version string) string {
+	h := sha1.New()
+	h.Write([]byte(id + "\x00" + version))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newBlockCache returns a cache in dir which holds at most limit bytes. The
+// blocks already stored in dir are reused. If limit is not positive, nil is
+// returned.
+func newBlockCache(dir string, limit int64) *blockCache {
+	if limit <= 0 {
+		return nil
+	}
+	c := &blockCache{
+		dir:   dir,
+		limit: limit,
+		lru:   list.New(),
+		index: make(map[blockKey]*list.Element),
+	}
+	type found struct {
+		block *cachedBlock
+		mtime time.Time
+	}
+	var all []found
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		i, err := strconv.ParseInt(info.Name(), 10, 64)
+		if err != nil {
+			return nil
+		}
+		key := blockKey{filepath.Base(filepath.Dir(path)), i}
+		all = append(all, found{&cachedBlock{key, info.Size()}, info.ModTime()})
+		return nil
+	})
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].mtime.After(all[j].mtime)
+	})
+	for _, f := range all {
+		c.index[f.block.key] = c.lru.PushBack(f.block)
+		c.size += f.block.size
+	}
+	c.Lock()
+	c.evict()
+	c.Unlock()
+	return c
+}
+
+func (c *blockCache) path(key blockKey) string {
+	return filepath.Join(c.dir, key.file, strconv.FormatInt(key.index, 10))
+}
+
+// get returns the block with the given index of the file version identified by
+// file, if it is cached.
+func (c *blockCache) get(file string, index int64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := blockKey{file, index}
+	c.Lock()
+	e := c.index[key]
+	if e != nil {
+		c.lru.MoveToFront(e)
+	}
+	c.Unlock()
+	if e == nil {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		log.Println("failed to read cached block:", err)
+		c.Lock()
+		if c.index[key] == e {
+			c.remove(e)
+		}
+		c.Unlock()
+		return nil, false
+	}
+	// Keep the order across restarts.
+	t := time.Now()
+	os.Chtimes(c.path(key), t, t)
+	return data, true
+}
+
+// has reports whether a block is cached without reading it.
+func (c *blockCache) has(file string, index int64) bool {
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.index[blockKey{file, index}] != nil
+}
+
+// put stores a block in the cache.
+func (c *blockCache) put(file string, index int64, data []byte) {
+	if c == nil {
+		return
+	}
+	key := blockKey{file, index}
+	p := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		log.Println("failed to cache block:", err)
+		return
+	}
+	if err := ioutil.WriteFile(p, data, 0600); err != nil {
+		log.Println("failed to cache block:", err)
+		os.Remove(p)
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e := c.index[key]; e != nil {
+		c.size -= e.Value.(*cachedBlock).size
+		c.lru.Remove(e)
+	}
+	c.index[key] = c.lru.PushFront(&cachedBlock{key, int64(len(data))})
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// c must already be locked
+func (c *blockCache) evict() {
+	for c.size > c.limit {
+		c.remove(c.lru.Back())
+	}
+}
+
+// c must already be locked
+func (c *blockCache) remove(e *list.Element) {
+	b := c.lru.Remove(e).(*cachedBlock)
+	delete(c.index, b.key)
+	c.size -= b.size
+	os.Remove(c.path(b.key))
+	// Only succeeds once the directory is empty.
+	os.Remove(filepath.Join(c.dir, b.key.file))
+}
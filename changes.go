@@ -0,0 +1,200 @@
+package main
+
+import (
+	"code.google.com/p/google-api-go-client/drive/v2"
+	"log"
+	"time"
+)
+
+// pollChanges periodically applies the changes made to the Drive since the
+// last check.
+func (fs *Filesystem) pollChanges(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if isReadOnly() {
+			continue
+		}
+		if err := fs.applyChanges(true); err != nil {
+			log.Println("failed to apply changes:", err)
+		}
+	}
+}
+
+// applyChanges applies the changes since the last call. If notify is true, the
+// kernel's caches are invalidated for the affected entries.
+func (fs *Filesystem) applyChanges(notify bool) error {
+	var pageToken string
+	for {
+		list, err := listChanges(fs.changeId+1, pageToken)
+		if err != nil {
+			return err
+		}
+		for _, c := range list.Items {
+			fs.applyChange(&c, notify)
+		}
+		if list.NextPageToken == "" {
+			fs.Lock()
+			if list.LargestChangeId > fs.changeId {
+				fs.changeId = list.LargestChangeId
+			}
+			fs.Unlock()
+			return nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+func (fs *Filesystem) applyChange(c *driveChange, notify bool) {
+	fs.Lock()
+	n := fs.idToNode[c.FileId]
+	fs.Unlock()
+	// Files deleted in the web interface are moved to the trash.
+	if c.Deleted || c.File == nil || c.File.Labels.Trashed {
+		if n != nil {
+			fs.removeNode(c.FileId, n, notify)
+		}
+		return
+	}
+	if n != nil && !sameType(n, c.File) {
+		// e.g. a file converted to a document
+		fs.removeNode(c.FileId, n, notify)
+		n = nil
+	}
+	if n == nil {
+		if *lazy && !fs.anyListed(c.File.Parents) {
+			// The file will be loaded when one of its parents is listed.
+			return
+		}
+		n = newNode(c.File, fs.inoFor(c.FileId))
+		fs.addNode(c.File, n)
+	} else {
+		fs.setFile(c.File)
+		updateNode(n, c.File)
+	}
+	fs.relink(n, c.File.Parents, notify)
+}
+
+// removeNode removes n, which has the given id, from all directories.
+func (fs *Filesystem) removeNode(id string, n Node, notify bool) {
+	fs.relink(n, nil, notify)
+	fs.Lock()
+	delete(fs.idToNode, id)
+	delete(fs.files, id)
+	fs.Unlock()
+}
+
+// anyListed reports whether any of parents is a directory whose children have
+// been listed.
+func (fs *Filesystem) anyListed(parents []drive.ParentReference) bool {
+	for _, p := range parents {
+		fs.Lock()
+		parent, _ := fs.idToNode[p.Id].(*dirNode)
+		fs.Unlock()
+		if parent != nil {
+			parent.listLock.Lock()
+			listed := !parent.listed.IsZero()
+			parent.listLock.Unlock()
+			if listed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relink makes n the child of the directories among parents, removing it
+// from all other directories. If notify is true, the kernel's cache of the
+// affected entries is invalidated. This must not be done while serving a
+// request for one of the directories, since the kernel holds locks on them.
+func (fs *Filesystem) relink(n Node, parents []drive.ParentReference, notify bool) {
+	want := make(map[*dirNode]bool)
+	fs.Lock()
+	for _, p := range parents {
+		if parent, _ := fs.idToNode[p.Id].(*dirNode); parent != nil {
+			want[parent] = true
+			// See OnMount for why directories only get one parent.
+			if _, ok := n.(*dirNode); ok {
+				break
+			}
+		}
+	}
+	old := append([]link(nil), fs.links[n]...)
+	fs.Unlock()
+	name := n.Name()
+	for _, l := range old {
+		if want[l.dir] && l.title == name {
+			delete(want, l.dir)
+			continue
+		}
+		l.dir.Lock()
+		l.dir.rmChild(l.name)
+		l.dir.Unlock()
+		if notify {
+			fs.conn.EntryNotify(l.dir.Inode(), l.name)
+		}
+	}
+	for dir := range want {
+		dir.Lock()
+		dir.addChild(name, n)
+		dir.Unlock()
+		if notify {
+			fs.conn.EntryNotify(dir.Inode(), name)
+		}
+	}
+	if n, ok := n.(*fileNode); ok {
+		fs.Lock()
+		nlink := len(fs.links[n])
+		fs.Unlock()
+		n.Lock()
+		n.nlink = nlink
+		n.Unlock()
+	}
+	if notify {
+		fs.conn.FileNotify(n.Inode(), 0, 0)
+	}
+}
+
+// updateNode sets the metadata of n to that of file.
+func updateNode(n Node, file *driveFile) {
+	switch n := n.(type) {
+	case *dirNode:
+		n.Lock()
+		n.setMetadata(file)
+		n.Unlock()
+	case *docDirNode:
+		n.Lock()
+		if n.name != file.Title {
+			n.rename(file.Title)
+		}
+		n.setMetadata(file)
+		children := n.Inode().Children()
+		n.Unlock()
+		// The exported files may have changed in size.
+		for _, cinode := range children {
+			c := cinode.FsNode().(*docNode)
+			c.Lock()
+			if c.staged == nil {
+				c.hasSize = false
+			}
+			c.Unlock()
+		}
+	case *docNode:
+		n.Lock()
+		n.dir.Lock()
+		n.dir.setMetadata(file)
+		n.name = n.dir.name + n.ext
+		n.dir.Unlock()
+		// The export has changed in size, unless it is being edited.
+		if n.staged == nil {
+			n.hasSize = false
+		}
+		n.Unlock()
+	case *fileNode:
+		n.Lock()
+		// Local changes which are not uploaded yet take precedence.
+		if n.staged == nil {
+			n.setMetadata(file)
+		}
+		n.Unlock()
+	}
+}
@@ -1,14 +1,31 @@
 package main
 
 import (
+	"bytes"
 	"code.google.com/p/google-api-go-client/drive/v2"
 	"encoding/json"
 	"errors"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	neturl "net/url"
+	"strconv"
 )
 
-type driveFileList struct {
-	Items []driveFile
+// fileFields are the fields of a file we request from the API.
+const fileFields = "createdDate%2CdownloadUrl%2Ceditable%2CexportLinks%2CfileSize%2Cid%2Clabels%2Ftrashed%2ClastViewedByMeDate%2Cmd5Checksum%2CmimeType%2CmodifiedDate%2Cparents%2Ctitle"
+
+type driveChange struct {
+	Deleted bool
+	File    *driveFile
+	FileId  string
+}
+
+type driveChangeList struct {
+	Items           []driveChange
+	LargestChangeId int64 `json:",string"`
+	NextPageToken   string
 }
 
 // We define our own type because the one from google-api-go-client is bugged
@@ -20,20 +37,43 @@ type driveFile struct {
 	ExportLinks        map[string]string
 	FileSize           int64 `json:",string"`
 	Id                 string
+	Labels             struct{ Trashed bool }
 	LastViewedByMeDate string
+	Md5Checksum        string
 	MimeType           string
 	ModifiedDate       string
 	Parents            []drive.ParentReference
 	Title              string
 }
 
+// newDriveFile converts a file returned by google-api-go-client to our own
+// type. Export links are lost in the process.
+func newDriveFile(f *drive.File) *driveFile {
+	file := &driveFile{
+		CreatedDate:        f.CreatedDate,
+		DownloadUrl:        f.DownloadUrl,
+		Editable:           f.Editable,
+		FileSize:           f.FileSize,
+		Id:                 f.Id,
+		LastViewedByMeDate: f.LastViewedByMeDate,
+		Md5Checksum:        f.Md5Checksum,
+		MimeType:           f.MimeType,
+		ModifiedDate:       f.ModifiedDate,
+		Title:              f.Title,
+	}
+	for _, p := range f.Parents {
+		file.Parents = append(file.Parents, *p)
+	}
+	return file
+}
+
 func getRoot() (root *driveFile, err error) {
 	const url = "https://www.googleapis.com/drive/v2/files/root?fields=createdDate%2Ceditable%2Cid%2ClastViewedByMeDate%2CmodifiedDate%2Ctitle"
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return
 	}
-	resp, err := transport.Client().Do(req)
+	resp, err := authClient().Do(req)
 	if err != nil {
 		return
 	}
@@ -47,19 +87,229 @@ func getRoot() (root *driveFile, err error) {
 	return
 }
 
-func listFiles() (list driveFileList, err error) {
-	const url = "https://www.googleapis.com/drive/v2/files?maxResults=2147483647&fields=items(createdDate%2CdownloadUrl%2Ceditable%2CexportLinks%2CfileSize%2Cid%2ClastViewedByMeDate%2CmimeType%2CmodifiedDate%2Cparents%2Ctitle)"
+// listFiles returns all files matching the search query q (or all files if it
+// is empty), requesting them page by page. progress, if not nil, is called
+// with the number of files listed so far after each page.
+func listFiles(q string, progress func(n int)) (files []driveFile, err error) {
+	var pageToken string
+	for {
+		files, pageToken, err = listFilesPage(files, q, pageToken)
+		if err != nil {
+			return
+		}
+		if progress != nil {
+			progress(len(files))
+		}
+		if pageToken == "" {
+			return
+		}
+	}
+}
+
+// listFilesPage appends the files matching q from the page referred to by
+// pageToken (or the first page, if it is empty) to files. The items are
+// decoded one at a time, so that the page doesn't have to be kept in memory as
+// a whole.
+func listFilesPage(files []driveFile, q, pageToken string) ([]driveFile, string, error) {
+	url := "https://www.googleapis.com/drive/v2/files?maxResults=1000&fields=items(" +
+		fileFields + ")%2CnextPageToken"
+	if q != "" {
+		url += "&q=" + neturl.QueryEscape(q)
+	}
+	if pageToken != "" {
+		url += "&pageToken=" + neturl.QueryEscape(pageToken)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return files, "", err
+	}
+	resp, err := authClient().Do(req)
+	if err != nil {
+		return files, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return files, "", errors.New(resp.Status)
+	}
+	dec := json.NewDecoder(resp.Body)
+	if _, err = dec.Token(); err != nil {
+		return files, "", err
+	}
+	pageToken = ""
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return files, "", err
+		}
+		switch t {
+		case "items":
+			if _, err = dec.Token(); err != nil {
+				return files, "", err
+			}
+			for dec.More() {
+				var f driveFile
+				if err = dec.Decode(&f); err != nil {
+					return files, "", err
+				}
+				files = append(files, f)
+			}
+			_, err = dec.Token()
+		case "nextPageToken":
+			err = dec.Decode(&pageToken)
+		default:
+			var v json.RawMessage
+			err = dec.Decode(&v)
+		}
+		if err != nil {
+			return files, "", err
+		}
+	}
+	return files, pageToken, nil
+}
+
+// updateContent replaces the content of the file with the given id by the
+// first size bytes of r in a single request and returns the updated metadata.
+func updateContent(id string, r io.ReaderAt, size int64) (*driveFile, error) {
+	f, err := srv.Files.Update(id, new(drive.File)).Media(io.NewSectionReader(r, 0, size)).Do()
+	if err != nil {
+		return nil, err
+	}
+	return newDriveFile(f), nil
+}
+
+// importContent replaces the content of the document with the given id by
+// size bytes read from r, which are converted from the format mime.
+func importContent(id, mime string, r io.ReaderAt, size int64) (*driveFile, error) {
+	url := "https://www.googleapis.com/upload/drive/v2/files/" + id +
+		"?uploadType=media&convert=true&fields=" + fileFields
+	req, err := http.NewRequest("PUT", url, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", mime)
+	return doFileRequest(req)
+}
+
+// insertDocument creates a document with the given title in the folder with id
+// parent from size bytes read from r, which are converted from the format mime.
+func insertDocument(title, parent, mime string, r io.ReaderAt, size int64) (*driveFile, error) {
+	meta, err := json.Marshal(map[string]interface{}{
+		"title":   title,
+		"parents": []map[string]string{{"id": parent}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	body := new(bytes.Buffer)
+	w := multipart.NewWriter(body)
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	if err != nil {
+		return nil, err
+	}
+	part.Write(meta)
+	part, err = w.CreatePart(textproto.MIMEHeader{"Content-Type": {mime}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(part, io.NewSectionReader(r, 0, size)); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	url := "https://www.googleapis.com/upload/drive/v2/files" +
+		"?uploadType=multipart&convert=true&fields=" + fileFields
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "multipart/related; boundary="+w.Boundary())
+	return doFileRequest(req)
+}
+
+// createDocument creates an empty document of the given type, e.g.
+// "spreadsheet", with the given title in the folder with id parent.
+func createDocument(title, parent, typ string) (*driveFile, error) {
+	meta, err := json.Marshal(map[string]interface{}{
+		"title":    title,
+		"mimeType": "application/vnd.google-apps." + typ,
+		"parents":  []map[string]string{{"id": parent}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	url := "https://www.googleapis.com/drive/v2/files?fields=" + fileFields
+	req, err := http.NewRequest("POST", url, bytes.NewReader(meta))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doFileRequest(req)
+}
+
+// doFileRequest sends a request whose response is the metadata of a file.
+func doFileRequest(req *http.Request) (*driveFile, error) {
+	resp, err := authClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, errors.New(resp.Status)
+	}
+	file := new(driveFile)
+	dec := json.NewDecoder(resp.Body)
+	if err = dec.Decode(file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func getLargestChangeId() (id int64, err error) {
+	const url = "https://www.googleapis.com/drive/v2/about?fields=largestChangeId"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	resp, err := authClient().Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return 0, errors.New(resp.Status)
+	}
+	var about struct {
+		LargestChangeId int64 `json:",string"`
+	}
+	dec := json.NewDecoder(resp.Body)
+	err = dec.Decode(&about)
+	return about.LargestChangeId, err
+}
+
+// listChanges returns a page of the changes starting with the one with the
+// given id. If pageToken is not empty, the page it refers to is returned
+// instead.
+func listChanges(start int64, pageToken string) (list driveChangeList, err error) {
+	url := "https://www.googleapis.com/drive/v2/changes?fields=items(deleted%2CfileId%2Cfile(" +
+		fileFields + "))%2ClargestChangeId%2CnextPageToken"
+	if pageToken != "" {
+		url += "&pageToken=" + neturl.QueryEscape(pageToken)
+	} else {
+		url += "&startChangeId=" + strconv.FormatInt(start, 10)
+	}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return
 	}
-	resp, err := transport.Client().Do(req)
+	resp, err := authClient().Do(req)
 	if err != nil {
 		return
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 400 {
-		return driveFileList{}, errors.New(resp.Status)
+		return driveChangeList{}, errors.New(resp.Status)
 	}
 	dec := json.NewDecoder(resp.Body)
 	err = dec.Decode(&list)
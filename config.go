@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// clientConfig is the content of the config file. It names the OAuth client
+// drivefs identifies itself as.
+type clientConfig struct {
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// The client secret files downloaded from the Google API Console have
+	// the client in this field.
+	Installed *clientConfig `json:"installed"`
+}
+
+func getConfigFile() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			log.Fatalln("Failed to determine config location (neither HOME nor" +
+				" XDG_CONFIG_HOME are set)")
+		}
+		return profileDir(home+"/.config/drivefs") + "/config.json"
+	}
+	return profileDir(configHome+"/drivefs") + "/config.json"
+}
+
+func loadConfig(path string) (*clientConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	conf := new(clientConfig)
+	if err = json.NewDecoder(f).Decode(conf); err != nil {
+		return nil, err
+	}
+	if conf.Installed != nil {
+		conf = conf.Installed
+	}
+	return conf, nil
+}
+
+// configureClient sets the OAuth client of oauthConf. The built-in client is
+// overridden by the config file, which is overridden by the environment
+// variables DRIVEFS_CLIENT_ID and DRIVEFS_CLIENT_SECRET, which are overridden
+// by the flags.
+func configureClient() {
+	conf, err := loadConfig(*configFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalln("Failed to read config file:", err)
+	}
+	if conf != nil && conf.ClientId != "" {
+		oauthConf.ClientId = conf.ClientId
+		oauthConf.ClientSecret = conf.ClientSecret
+	}
+	if id := os.Getenv("DRIVEFS_CLIENT_ID"); id != "" {
+		oauthConf.ClientId = id
+		oauthConf.ClientSecret = os.Getenv("DRIVEFS_CLIENT_SECRET")
+	}
+	if *clientId != "" {
+		oauthConf.ClientId = *clientId
+		oauthConf.ClientSecret = *clientSecret
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+const (
+	// maxReadahead is the maximum number of blocks prefetched ahead of a
+	// sequential reader.
+	maxReadahead = 16
+	// maxPrefetches is the maximum number of blocks prefetched at once.
+	maxPrefetches = 4
+)
+
+var errNoRanges = errors.New("server does not support range requests")
+
+// prefetchSlots limits the number of running prefetches.
+var prefetchSlots = make(chan struct{}, maxPrefetches)
+
+// A content gives random access to the content of a file or an exported
+// document. It is downloaded in blocks, which are kept in the block cache. If
+// the server supports range requests, only the blocks which are read are
+// downloaded, and blocks ahead of sequential readers are prefetched.
+// Otherwise, the content is downloaded sequentially. A content may be read
+// from several goroutines at once; readers only wait for the blocks they
+// need.
+type content struct {
+	key       string
+	url       string
+	ranged    bool
+	size      int64 // -1 if unknown
+	stream    io.ReadCloser
+	streamOff int64
+	streamMu  sync.Mutex // held while using stream
+	last      []byte     // the block read most recently
+	lastIndex int64
+	pending   map[int64]*blockFetch
+	window    int // number of blocks to prefetch
+	mu        sync.Mutex
+}
+
+// A blockFetch is a range request for a block.
+type blockFetch struct {
+	done chan struct{} // closed when the request has finished
+	data []byte
+	err  error
+}
+
+// newContent returns a content for the download URL url. key identifies the
+// version of the content in the cache. ranged indicates whether range requests
+// should be tried.
+func newContent(key, url string, size int64, ranged bool) *content {
+	return &content{
+		key:       key,
+		url:       url,
+		ranged:    ranged,
+		size:      size,
+		lastIndex: -1,
+		pending:   make(map[int64]*blockFetch),
+	}
+}
+
+// ReadAt reads len(dest) bytes starting at off. Fewer bytes are read only at
+// the end of the content.
+func (c *content) ReadAt(dest []byte, off int64) (int, error) {
+	n := 0
+	for n < len(dest) {
+		i := (off + int64(n)) / blockSize
+		b, err := c.block(i)
+		if err != nil {
+			return n, err
+		}
+		start := off + int64(n) - i*blockSize
+		if start >= int64(len(b)) {
+			break
+		}
+		n += copy(dest[n:], b[start:])
+		if len(b) < blockSize {
+			break
+		}
+	}
+	return n, nil
+}
+
+// block returns the block with index i, which is empty after the end of the
+// content.
+func (c *content) block(i int64) ([]byte, error) {
+	c.mu.Lock()
+	if i == c.lastIndex {
+		b := c.last
+		c.mu.Unlock()
+		return b, nil
+	}
+	if c.size >= 0 && i*blockSize >= c.size {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	ranged := c.ranged
+	c.mu.Unlock()
+	b, ok := blocks.get(c.key, i)
+	if !ok {
+		var err error
+		if ranged {
+			b, err = c.wait(i)
+			if err == errNoRanges {
+				ranged = false
+			}
+		}
+		if !ranged {
+			b, err = c.download(i)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	if ranged {
+		c.readahead(i)
+	}
+	c.last, c.lastIndex = b, i
+	c.mu.Unlock()
+	return b, nil
+}
+
+// readahead adapts the prefetch window to the access pattern and prefetches
+// the blocks following block i. The window grows while the blocks are read
+// one after another and is reset by any other access. c.mu must already be
+// locked.
+func (c *content) readahead(i int64) {
+	if i == c.lastIndex+1 {
+		if c.window == 0 {
+			c.window = 1
+		} else if c.window < maxReadahead {
+			c.window *= 2
+		}
+	} else {
+		c.window = 0
+	}
+	for j, f := range c.pending {
+		// Without a cache, finished prefetches stay in pending until they
+		// are read, so drop those which have been skipped.
+		if j < i && isDone(f) {
+			delete(c.pending, j)
+		}
+	}
+	for j := i + 1; j <= i+int64(c.window); j++ {
+		if c.size >= 0 && j*blockSize >= c.size {
+			break
+		}
+		if c.pending[j] == nil && !blocks.has(c.key, j) {
+			c.start(j, true)
+		}
+	}
+}
+
+func isDone(f *blockFetch) bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait returns block i, fetching it unless a prefetch for it is in progress.
+func (c *content) wait(i int64) ([]byte, error) {
+	c.mu.Lock()
+	f := c.start(i, false)
+	c.mu.Unlock()
+	<-f.done
+	c.mu.Lock()
+	if c.pending[i] == f {
+		delete(c.pending, i)
+	}
+	c.mu.Unlock()
+	return f.data, f.err
+}
+
+// start begins fetching block i in the background unless that is already in
+// progress. If prefetch is true, the request waits for a free prefetch slot.
+// c.mu must already be locked.
+func (c *content) start(i int64, prefetch bool) *blockFetch {
+	if f := c.pending[i]; f != nil {
+		return f
+	}
+	f := &blockFetch{done: make(chan struct{})}
+	c.pending[i] = f
+	go func() {
+		if prefetch {
+			prefetchSlots <- struct{}{}
+		}
+		f.data, f.err = c.fetch(i)
+		if prefetch {
+			<-prefetchSlots
+		}
+		c.mu.Lock()
+		if f.err == errNoRanges {
+			c.ranged = false
+		}
+		// Without a cache, the data is kept here until it is read.
+		if blocks != nil || f.err != nil {
+			delete(c.pending, i)
+		}
+		c.mu.Unlock()
+		close(f.done)
+	}()
+	return f
+}
+
+// fetch downloads block i using a range request.
+func (c *content) fetch(i int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", i*blockSize, (i+1)*blockSize-1))
+	resp, err := authClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, nil
+	case http.StatusOK:
+		return nil, errNoRanges
+	default:
+		return nil, errors.New(resp.Status)
+	}
+	b := make([]byte, blockSize)
+	n, err := io.ReadFull(resp.Body, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	size := c.size
+	c.mu.Unlock()
+	if size >= 0 && int64(n) < blockSize && i*blockSize+int64(n) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b = b[:n]
+	blocks.put(c.key, i, b)
+	return b, nil
+}
+
+// download reads the content from the start (or where the last download
+// stopped, if that is before block i) up to and including block i, caching
+// all blocks on the way.
+func (c *content) download(i int64) ([]byte, error) {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	// Another reader may have downloaded the block in the meantime.
+	if b, ok := blocks.get(c.key, i); ok {
+		return b, nil
+	}
+	c.mu.Lock()
+	size := c.size
+	c.mu.Unlock()
+	if size >= 0 && i*blockSize >= size {
+		return nil, nil
+	}
+	if c.stream == nil || c.streamOff > i*blockSize {
+		c.closeStream()
+		resp, err := authClient().Get(c.url)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 400 {
+			resp.Body.Close()
+			return nil, errors.New(resp.Status)
+		}
+		c.stream = resp.Body
+		c.streamOff = 0
+	}
+	for {
+		b := make([]byte, blockSize)
+		n, err := io.ReadFull(c.stream, b)
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			c.closeStream()
+			return nil, err
+		}
+		b = b[:n]
+		j := c.streamOff / blockSize
+		blocks.put(c.key, j, b)
+		c.streamOff += int64(n)
+		if eof {
+			c.mu.Lock()
+			c.size = c.streamOff
+			c.mu.Unlock()
+			c.closeStream()
+		}
+		if j == i {
+			return b, nil
+		}
+		if eof {
+			return nil, nil
+		}
+	}
+}
+
+// length returns the size of the content, or -1 if it is not known yet.
+func (c *content) length() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Close stops any running sequential download.
+func (c *content) Close() error {
+	c.streamMu.Lock()
+	defer c.streamMu.Unlock()
+	return c.closeStream()
+}
+
+// c.streamMu must already be locked
+func (c *content) closeStream() error {
+	if c.stream == nil {
+		return nil
+	}
+	err := c.stream.Close()
+	c.stream = nil
+	return err
+}
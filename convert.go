@@ -0,0 +1,278 @@
+package main
+
+import (
+	"github.com/hanwen/go-fuse/fuse"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// docSuffix marks files which are converted to documents when they are
+// created, e.g. "notes.gdoc.docx".
+const docSuffix = ".gdoc"
+
+// convertTarget returns the title of the document to which a file called name
+// which is created in the folder dirName is converted, and the MIME type of its
+// content. ok is false if the file isn't converted.
+func convertTarget(dirName, name string) (title, mime string, ok bool) {
+	ext := path.Ext(name)
+	if importExts[ext] == "" {
+		return "", "", false
+	}
+	title = strings.TrimSuffix(name, ext)
+	switch {
+	case strings.HasSuffix(title, docSuffix) && title != docSuffix:
+		title = strings.TrimSuffix(title, docSuffix)
+	case *convertDir != "" && dirName == *convertDir:
+	default:
+		return "", "", false
+	}
+	return title, extToMime(ext), true
+}
+
+// unconverted holds the convertNodes whose content hasn't been converted yet.
+var unconverted = struct {
+	nodes map[*convertNode]bool
+	sync.Mutex
+}{nodes: make(map[*convertNode]bool)}
+
+// A convertNode is a newly created file which is converted to a document once
+// it has been written and closed. Until then, it only exists locally.
+type convertNode struct {
+	dir      *dirNode
+	ino      uint64
+	mime     string
+	mtime    time.Time
+	name     string
+	refcount int
+	size     uint64
+	staged   *os.File
+	title    string
+	toDelete bool
+	fuse.DefaultFsNode
+	sync.Mutex
+}
+
+func newConvertNode(dir *dirNode, name, title, mime string) (*convertNode, error) {
+	tmp, _, err := stageFile("convert", "")
+	if err != nil {
+		return nil, err
+	}
+	n := &convertNode{
+		dir:    dir,
+		ino:    fs.inoFor(tmp.Name()),
+		mime:   mime,
+		mtime:  time.Now(),
+		name:   name,
+		staged: tmp,
+		title:  title,
+	}
+	_ = fs.root.Inode().New(false, n)
+	unconverted.Lock()
+	unconverted.nodes[n] = true
+	unconverted.Unlock()
+	return n, nil
+}
+
+func (n *convertNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
+	if n == nil {
+		return fuse.ENOENT
+	}
+	n.Lock()
+	defer n.Unlock()
+	out.Ino = n.ino
+	out.SetTimes(&n.mtime, &n.mtime, nil)
+	out.Owner.Uid = fs.uid
+	out.Owner.Gid = fs.gid
+	out.Mode = fuse.S_IFREG | 0600
+	out.Size = n.size
+	return fuse.OK
+}
+
+// The id is only known once the file has been converted.
+func (n *convertNode) Id() string {
+	return ""
+}
+
+func (n *convertNode) Name() string {
+	return n.name
+}
+
+func (n *convertNode) Open(flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	n.Lock()
+	defer n.Unlock()
+	if context.Uid != fs.uid || n.staged == nil {
+		return nil, fuse.EPERM
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		if code := n.truncate(0); !code.Ok() {
+			return nil, code
+		}
+	}
+	n.refcount++
+	return &convertFile{node: n}, fuse.OK
+}
+
+func (n *convertNode) Truncate(file fuse.File, size uint64, context *fuse.Context) fuse.Status {
+	n.Lock()
+	defer n.Unlock()
+	if context.Uid != fs.uid || n.staged == nil {
+		return fuse.EPERM
+	}
+	return n.truncate(size)
+}
+
+// n must already be locked
+func (n *convertNode) truncate(size uint64) fuse.Status {
+	if err := n.staged.Truncate(int64(size)); err != nil {
+		log.Print(err)
+		return fuse.EIO
+	}
+	n.size = size
+	n.mtime = time.Now()
+	return fuse.OK
+}
+
+func (n *convertNode) Utimens(file fuse.File, atime, mtime *time.Time, context *fuse.Context) fuse.Status {
+	n.Lock()
+	defer n.Unlock()
+	if mtime != nil {
+		n.mtime = *mtime
+	}
+	return fuse.OK
+}
+
+// unlink discards n. n must already be locked.
+func (n *convertNode) unlink() {
+	n.toDelete = true
+	if n.refcount == 0 {
+		n.discard()
+	}
+}
+
+// discard removes the staged content of n. n must already be locked.
+func (n *convertNode) discard() {
+	if n.staged == nil {
+		return
+	}
+	n.staged.Close()
+	os.Remove(n.staged.Name())
+	fs.releaseIno(n.staged.Name())
+	n.staged = nil
+	unconverted.Lock()
+	delete(unconverted.nodes, n)
+	unconverted.Unlock()
+}
+
+// convert creates the document from the staged content of n and replaces n
+// with it in the tree. Empty files aren't converted yet, since they are likely
+// about to be written; see convertPending. If it fails, n stays so that the
+// content isn't lost. n must not be locked.
+func (n *convertNode) convert() {
+	n.Lock()
+	if n.staged == nil || n.size == 0 || n.refcount > 0 {
+		n.Unlock()
+		return
+	}
+	// n may be renamed once it is unlocked.
+	dir, name := n.dir, n.name
+	file, err := n.insert()
+	n.Unlock()
+	if err != nil {
+		log.Printf("failed to convert %s: %v", name, err)
+		return
+	}
+
+	dir.Lock()
+	if cinode := dir.Inode().GetChild(name); cinode != nil && cinode.FsNode() == n {
+		dir.rmChild(name)
+	}
+	dir.Unlock()
+	fs.conn.EntryNotify(dir.Inode(), name)
+	fs.applyChange(&driveChange{File: file, FileId: file.Id}, true)
+}
+
+// insert creates the document from the staged content of n and discards the
+// content. Since empty content can't be converted, an empty document is
+// created for it instead. n must already be locked.
+func (n *convertNode) insert() (*driveFile, error) {
+	var (
+		file *driveFile
+		err  error
+	)
+	if n.size == 0 {
+		file, err = createDocument(n.title, n.dir.Id(), importExts[path.Ext(n.name)])
+	} else {
+		file, err = insertDocument(n.title, n.dir.Id(), n.mime, n.staged, int64(n.size))
+	}
+	if err != nil {
+		return nil, err
+	}
+	n.discard()
+	return file, nil
+}
+
+// convertPending creates the documents of the files which haven't been
+// converted when drivefs is unmounted, e.g. because they are still empty, so
+// that they aren't lost silently.
+func convertPending() {
+	unconverted.Lock()
+	var nodes []*convertNode
+	for n := range unconverted.nodes {
+		nodes = append(nodes, n)
+	}
+	unconverted.Unlock()
+	for _, n := range nodes {
+		n.Lock()
+		if n.toDelete {
+			n.discard()
+		} else if n.staged != nil {
+			name := n.staged.Name()
+			if _, err := n.insert(); err != nil {
+				log.Printf("failed to convert %s: %v, its content is kept in %s", n.name, err, name)
+			}
+		}
+		n.Unlock()
+	}
+}
+
+type convertFile struct {
+	fuse.DefaultFile
+	node *convertNode
+}
+
+func (f *convertFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.node.Lock()
+	defer f.node.Unlock()
+	return readStaged(f.node.staged, dest, off)
+}
+
+func (f *convertFile) Release() {
+	f.node.Lock()
+	f.node.refcount--
+	last := f.node.refcount == 0
+	if last && f.node.toDelete {
+		f.node.discard()
+	}
+	f.node.Unlock()
+	if last {
+		f.node.convert()
+	}
+}
+
+func (f *convertFile) Truncate(size uint64) fuse.Status {
+	f.node.Lock()
+	defer f.node.Unlock()
+	return f.node.truncate(size)
+}
+
+func (f *convertFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.node.Lock()
+	defer f.node.Unlock()
+	f.node.mtime = time.Now()
+	return writeStaged(f.node.staged, data, off, &f.node.size)
+}
@@ -4,29 +4,42 @@ import (
 	"code.google.com/p/google-api-go-client/drive/v2"
 	"github.com/hanwen/go-fuse/fuse"
 	"log"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
 type dirNode struct {
-	atime time.Time
-	id    string
-	ino   uint64
-	mode  uint32
-	mtime time.Time
-	name  string
+	atime    time.Time
+	dups     map[string][]Node
+	id       string
+	ino      uint64
+	listed   time.Time
+	listLock sync.Mutex
+	mode     uint32
+	mtime    time.Time
+	name     string
 	fuse.DefaultFsNode
 	sync.RWMutex
 }
 
 func newDirNode(file *driveFile, ino uint64) *dirNode {
-	var err error
-
 	n := new(dirNode)
 	_ = fs.root.Inode().New(true, n)
-	n.id = file.Id
 	n.ino = ino
+	n.setMetadata(file)
+	return n
+}
+
+// setMetadata sets the attributes of n from file. n must already be locked
+// for writing or not be visible to other goroutines yet.
+func (n *dirNode) setMetadata(file *driveFile) {
+	var err error
+
+	n.id = file.Id
 	n.name = file.Title
 	n.mtime, err = time.Parse(time.RFC3339, file.ModifiedDate)
 	if err != nil {
@@ -48,7 +61,214 @@ func newDirNode(file *driveFile, ino uint64) *dirNode {
 		n.atime = time.Unix(0, 0)
 		log.Println(n.name, err)
 	}
-	return n
+}
+
+// addChild adds c to n under the given title. Drive allows several files
+// with the same title in a folder, so if another child already has that
+// title, the older of them keeps it and the newer one gets a name with a
+// suffix derived from its id (see dupName). n must already be locked for
+// writing.
+func (n *dirNode) addChild(title string, c Node) {
+	cinode := n.Inode().GetChild(title)
+	if cinode == nil || cinode.FsNode() == c {
+		n.attach(title, title, c)
+		return
+	}
+	other := cinode.FsNode().(Node)
+	if other.Name() != title {
+		// other is a file whose own title looks like a suffixed name.
+		n.attach(dupName(title, c), title, c)
+		return
+	}
+	if n.dups == nil {
+		n.dups = make(map[string][]Node)
+	}
+	group := n.dups[title]
+	if group == nil {
+		group = []Node{other}
+	}
+	group = append(group, c)
+	n.dups[title] = group
+	n.attach(dupName(title, c), title, c)
+	n.arrange(title, group)
+}
+
+// rmChild removes the child with the given name from n. If it shared its
+// title with other children, their names are rearranged. n must already be
+// locked for writing.
+func (n *dirNode) rmChild(name string) {
+	c := n.detach(name)
+	if c == nil {
+		return
+	}
+	for title, group := range n.dups {
+		for i, g := range group {
+			if g != c {
+				continue
+			}
+			group = append(group[:i], group[i+1:]...)
+			if len(group) == 1 {
+				delete(n.dups, title)
+			} else {
+				n.dups[title] = group
+			}
+			n.arrange(title, group)
+			return
+		}
+	}
+}
+
+// arrange gives the oldest of a group of children sharing a title the title as
+// name and the others their suffixed names. n must already be locked for
+// writing.
+func (n *dirNode) arrange(title string, group []Node) {
+	type member struct {
+		node    Node
+		created string
+		id      string
+	}
+	members := make([]member, len(group))
+	fs.Lock()
+	for i, c := range group {
+		members[i].node = c
+		members[i].id = c.Id()
+		if f := fs.files[members[i].id]; f != nil {
+			members[i].created = f.CreatedDate
+		}
+	}
+	fs.Unlock()
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].created != members[j].created {
+			return members[i].created < members[j].created
+		}
+		return members[i].id < members[j].id
+	})
+	// Detach all children that are renamed first, so that none of them
+	// replaces another one.
+	var moved []Node
+	var names []string
+	for i, m := range members {
+		name := title
+		if i > 0 {
+			name = dupName(title, m.node)
+		}
+		if old := n.entryName(m.node); old != name {
+			n.detach(old)
+			moved = append(moved, m.node)
+			names = append(names, name)
+		}
+	}
+	for i, c := range moved {
+		n.attach(names[i], title, c)
+	}
+}
+
+// dupName returns the name of c if another child of its parent has the title
+// given to it. The last characters of the id of c are inserted before the
+// extension of the title, e.g. "report.pdf" becomes "report.a1b2c3d4.pdf".
+func dupName(title string, c Node) string {
+	id := c.Id()
+	if len(id) > 8 {
+		id = id[len(id)-8:]
+	}
+	switch c.(type) {
+	case *fileNode, *docNode:
+		ext := path.Ext(title)
+		return title[:len(title)-len(ext)] + "." + id + ext
+	}
+	return title + "." + id
+}
+
+// attach adds c to n under name. title is the title it was added for.
+func (n *dirNode) attach(name, title string, c Node) {
+	n.Inode().AddChild(name, c.Inode())
+	fs.Lock()
+	fs.links[c] = append(fs.links[c], link{n, name, title})
+	fs.Unlock()
+}
+
+// detach removes the child with the given name from n and returns it.
+func (n *dirNode) detach(name string) Node {
+	cinode := n.Inode().RmChild(name)
+	if cinode == nil {
+		return nil
+	}
+	c := cinode.FsNode().(Node)
+	fs.Lock()
+	defer fs.Unlock()
+	links := fs.links[c]
+	for i, l := range links {
+		if l.dir == n && l.name == name {
+			links = append(links[:i], links[i+1:]...)
+			break
+		}
+	}
+	if len(links) == 0 {
+		delete(fs.links, c)
+	} else {
+		fs.links[c] = links
+	}
+	return c
+}
+
+// entryName returns the name under which c is a child of n.
+func (n *dirNode) entryName(c Node) string {
+	fs.Lock()
+	defer fs.Unlock()
+	for _, l := range fs.links[c] {
+		if l.dir == n {
+			return l.name
+		}
+	}
+	return ""
+}
+
+func (n *dirNode) Create(name string, flags uint32, mode uint32, context *fuse.Context) (fuse.File, fuse.FsNode, fuse.Status) {
+	if isReadOnly() {
+		return nil, nil, fuse.Status(syscall.EROFS)
+	}
+	n.Lock()
+	defer n.Unlock()
+	if context.Uid != fs.uid || n.mode&0200 == 0 {
+		return nil, nil, fuse.EACCES
+	}
+	if n.Inode().GetChild(name) != nil {
+		return nil, nil, fuse.Status(syscall.EEXIST)
+	}
+	if title, mime, ok := convertTarget(n.name, name); ok {
+		child, err := newConvertNode(n, name, title, mime)
+		if err != nil {
+			log.Print(err)
+			return nil, nil, fuse.EIO
+		}
+		child.refcount = 1
+		n.addChild(name, child)
+		return &convertFile{node: child}, child, fuse.OK
+	}
+	f := &drive.File{Title: name, Parents: []*drive.ParentReference{{Id: n.id}}}
+	f, err := srv.Files.Insert(f).Do()
+	if err != nil {
+		log.Print(err)
+		return nil, nil, fuse.EIO
+	}
+	df := newDriveFile(f)
+	child := newFileNode(df, fs.inoFor(df.Id))
+	child.nlink = 1
+	child.refcount = 1
+	if err = child.stage(false); err != nil {
+		log.Print(err)
+		// Don't leave a file behind which isn't part of the tree.
+		if err = srv.Files.Delete(df.Id).Do(); err != nil {
+			log.Print(err)
+		}
+		fs.releaseIno(df.Id)
+		return nil, nil, fuse.EIO
+	}
+	fs.addNode(df, child)
+	n.addChild(name, child)
+	t := time.Now()
+	n.setTimes(&t, &t)
+	return &file{node: child}, child, fuse.OK
 }
 
 func (n *dirNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
@@ -66,6 +286,9 @@ func (n *dirNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context)
 }
 
 func (n *dirNode) Link(name string, existing fuse.FsNode, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	if isReadOnly() {
+		return nil, fuse.Status(syscall.EROFS)
+	}
 	n.Lock()
 	defer n.Unlock()
 	if context.Uid != fs.uid || n.mode&0200 == 0 {
@@ -94,16 +317,354 @@ func (n *dirNode) Link(name string, existing fuse.FsNode, context *fuse.Context)
 			return nil, fuse.EIO
 		}
 		old.nlink++
-		n.Inode().AddChild(name, old.Inode())
+		n.addChild(name, old)
 	}
 	return existing, fuse.OK
 }
 
+// load lists the children of n if the filesystem is lazily loaded and they
+// haven't been listed in the last lazyTTL. n must not be locked.
+func (n *dirNode) load() error {
+	if !*lazy {
+		return nil
+	}
+	n.listLock.Lock()
+	defer n.listLock.Unlock()
+	if !n.listed.IsZero() && time.Since(n.listed) < *lazyTTL {
+		return nil
+	}
+	n.RLock()
+	id := n.id
+	n.RUnlock()
+	files, err := listFiles("'"+id+"' in parents and trashed = false", nil)
+	if err != nil {
+		return err
+	}
+	listed := make(map[Node]bool)
+	for i := range files {
+		f := &files[i]
+		fs.Lock()
+		c := fs.idToNode[f.Id]
+		fs.Unlock()
+		if c != nil && !sameType(c, f) {
+			fs.removeNode(f.Id, c, false)
+			c = nil
+		}
+		if c == nil {
+			c = newNode(f, fs.inoFor(f.Id))
+			fs.addNode(f, c)
+		} else {
+			fs.setFile(f)
+			updateNode(c, f)
+		}
+		fs.relink(c, f.Parents, false)
+		listed[c] = true
+	}
+	n.Lock()
+	for name, cinode := range n.Inode().Children() {
+		c := cinode.FsNode().(Node)
+		if _, ok := c.(*convertNode); ok {
+			// Not on Drive yet.
+			continue
+		}
+		if !listed[c] {
+			n.rmChild(name)
+		}
+	}
+	n.Unlock()
+	n.listed = time.Now()
+	return nil
+}
+
+func (n *dirNode) Lookup(out *fuse.Attr, name string, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	if err := n.load(); err != nil {
+		log.Print(err)
+		return nil, fuse.EIO
+	}
+	n.RLock()
+	cinode := n.Inode().GetChild(name)
+	n.RUnlock()
+	if cinode == nil {
+		return nil, fuse.ENOENT
+	}
+	c := cinode.FsNode()
+	return c, c.GetAttr(out, nil, context)
+}
+
+func (n *dirNode) Mkdir(name string, mode uint32, context *fuse.Context) (fuse.FsNode, fuse.Status) {
+	if isReadOnly() {
+		return nil, fuse.Status(syscall.EROFS)
+	}
+	n.Lock()
+	defer n.Unlock()
+	if context.Uid != fs.uid || n.mode&0200 == 0 {
+		return nil, fuse.EACCES
+	}
+	if n.Inode().GetChild(name) != nil {
+		return nil, fuse.Status(syscall.EEXIST)
+	}
+	f := &drive.File{
+		Title:    name,
+		MimeType: folderMime,
+		Parents:  []*drive.ParentReference{{Id: n.id}},
+	}
+	f, err := srv.Files.Insert(f).Do()
+	if err != nil {
+		log.Print(err)
+		return nil, fuse.EIO
+	}
+	df := newDriveFile(f)
+	child := newDirNode(df, fs.inoFor(df.Id))
+	fs.addNode(df, child)
+	n.addChild(name, child)
+	t := time.Now()
+	n.setTimes(&t, &t)
+	return child, fuse.OK
+}
+
+func (n *dirNode) Id() string {
+	return n.id
+}
+
 func (n *dirNode) Name() string {
 	return n.name
 }
 
+func (n *dirNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if err := n.load(); err != nil {
+		log.Print(err)
+		return nil, fuse.EIO
+	}
+	return n.DefaultFsNode.OpenDir(context)
+}
+
+func (n *dirNode) Rename(oldName string, newParent fuse.FsNode, newName string, context *fuse.Context) fuse.Status {
+	if isReadOnly() {
+		return fuse.Status(syscall.EROFS)
+	}
+	np, ok := newParent.(*dirNode)
+	if !ok {
+		return fuse.EPERM
+	}
+	// Always lock the parents in the same order to avoid deadlocks with
+	// renames in the opposite direction.
+	if np == n {
+		n.Lock()
+		defer n.Unlock()
+	} else if n.id < np.id {
+		n.Lock()
+		defer n.Unlock()
+		np.Lock()
+		defer np.Unlock()
+	} else {
+		np.Lock()
+		defer np.Unlock()
+		n.Lock()
+		defer n.Unlock()
+	}
+	if context.Uid != fs.uid || n.mode&0200 == 0 || np.mode&0200 == 0 {
+		return fuse.EACCES
+	}
+	cinode := n.Inode().GetChild(oldName)
+	if cinode == nil {
+		return fuse.ENOENT
+	}
+	if np == n && oldName == newName {
+		return fuse.OK
+	}
+	// Files with several parents can be renamed to another of their names,
+	// which POSIX requires to do nothing.
+	if target := np.Inode().GetChild(newName); target != nil && target.FsNode() == cinode.FsNode() {
+		return fuse.OK
+	}
+	// The displayed names may have a suffix (see dupName), so the new name is
+	// compared with the title, and the names of the nodes are kept equal to
+	// their titles.
+	switch child := cinode.FsNode().(type) {
+	case (*fileNode):
+		child.Lock()
+		defer child.Unlock()
+		if child.mode&0200 == 0 {
+			return fuse.EPERM
+		}
+		title := newTitle(child.name, oldName, newName)
+		// XXX: Hard links share their title, so renaming one of them would
+		// rename all of them.
+		if child.nlink > 1 && title != "" {
+			return fuse.EPERM
+		}
+		if code := np.canReplace(newName, false); !code.Ok() {
+			return code
+		}
+		if err := moveFile(child.id, title, n.id, np.id); err != nil {
+			log.Print(err)
+			return fuse.EIO
+		}
+		if title != "" {
+			child.name = title
+		}
+	case (*dirNode):
+		child.Lock()
+		defer child.Unlock()
+		if child.mode&0200 == 0 {
+			return fuse.EPERM
+		}
+		if code := np.canReplace(newName, true); !code.Ok() {
+			return code
+		}
+		title := newTitle(child.name, oldName, newName)
+		if err := moveFile(child.id, title, n.id, np.id); err != nil {
+			log.Print(err)
+			return fuse.EIO
+		}
+		if title != "" {
+			child.name = title
+		}
+	case (*docDirNode):
+		child.Lock()
+		defer child.Unlock()
+		if child.mode&0200 == 0 {
+			return fuse.EPERM
+		}
+		if code := np.canReplace(newName, true); !code.Ok() {
+			return code
+		}
+		title := newTitle(child.name, oldName, newName)
+		if err := moveFile(child.id, title, n.id, np.id); err != nil {
+			log.Print(err)
+			return fuse.EIO
+		}
+		if title != "" {
+			child.rename(title)
+		}
+	case (*docNode):
+		child.Lock()
+		defer child.Unlock()
+		child.dir.Lock()
+		defer child.dir.Unlock()
+		if child.dir.mode&0200 == 0 {
+			return fuse.EPERM
+		}
+		// The extension isn't part of the title of the document.
+		ext := child.ext
+		if !strings.HasSuffix(newName, ext) {
+			return fuse.EINVAL
+		}
+		title := newTitle(child.name, oldName, newName)
+		if title != "" {
+			title = strings.TrimSuffix(title, ext)
+		}
+		if code := np.canReplace(newName, false); !code.Ok() {
+			return code
+		}
+		if err := moveFile(child.dir.id, title, n.id, np.id); err != nil {
+			log.Print(err)
+			return fuse.EIO
+		}
+		if title != "" {
+			child.name = title + ext
+			child.dir.name = title
+		}
+	case (*convertNode):
+		child.Lock()
+		defer child.Unlock()
+		if child.staged == nil {
+			return fuse.ENOENT
+		}
+		// The file only exists locally until it is converted, so it only has
+		// to be renamed to another name under which it is converted.
+		title, mime, ok := convertTarget(np.name, newName)
+		if !ok {
+			return fuse.EINVAL
+		}
+		if code := np.canReplace(newName, false); !code.Ok() {
+			return code
+		}
+		child.dir = np
+		child.name = newName
+		child.title = title
+		child.mime = mime
+	default:
+		return fuse.EINVAL
+	}
+	// The replaced file is only removed once the move has succeeded, so that
+	// nothing is lost if it fails.
+	np.replace(newName)
+	n.rmChild(oldName)
+	c := cinode.FsNode().(Node)
+	np.addChild(c.Name(), c)
+	t := time.Now()
+	n.setTimes(&t, &t)
+	if np != n {
+		np.setTimes(&t, &t)
+	}
+	return fuse.OK
+}
+
+// newTitle returns the title of a file titled title which is renamed from
+// oldName to newName, or "" if the title stays the same. Files which are moved
+// without being renamed keep their title, even if their name has a suffix.
+func newTitle(title, oldName, newName string) string {
+	if newName == oldName || newName == title {
+		return ""
+	}
+	return newName
+}
+
+// canReplace checks whether a file or directory (as indicated by isDir) can be
+// renamed to name, replacing the child called name, if any. n must already be
+// locked for writing.
+func (n *dirNode) canReplace(name string, isDir bool) fuse.Status {
+	cinode := n.Inode().GetChild(name)
+	if cinode == nil {
+		return fuse.OK
+	}
+	switch child := cinode.FsNode().(type) {
+	case (*fileNode):
+		if isDir {
+			return fuse.ENOTDIR
+		}
+		if child.mode&0200 == 0 {
+			return fuse.EPERM
+		}
+		return fuse.OK
+	case (*dirNode):
+		if !isDir {
+			return fuse.Status(syscall.EISDIR)
+		}
+		if len(child.Inode().Children()) != 0 {
+			return fuse.Status(syscall.ENOTEMPTY)
+		}
+		return fuse.OK
+	}
+	return fuse.Status(syscall.EEXIST)
+}
+
+// replace removes the child called name, if any, after another file or
+// directory has been moved over it. If it can't be deleted from Drive, it is
+// only removed from n. n must already be locked for writing.
+func (n *dirNode) replace(name string) {
+	cinode := n.Inode().GetChild(name)
+	if cinode == nil {
+		return
+	}
+	switch child := cinode.FsNode().(type) {
+	case (*fileNode):
+		if code := n.unlink(name); code.Ok() {
+			return
+		}
+	case (*dirNode):
+		if err := srv.Files.Delete(child.id).Do(); err != nil {
+			log.Print(err)
+		}
+	}
+	n.rmChild(name)
+}
+
 func (n *dirNode) Rmdir(name string, context *fuse.Context) fuse.Status {
+	if isReadOnly() {
+		return fuse.Status(syscall.EROFS)
+	}
 	n.Lock()
 	defer n.Unlock()
 	if context.Uid != fs.uid || n.mode&0200 == 0 {
@@ -123,7 +684,7 @@ func (n *dirNode) Rmdir(name string, context *fuse.Context) fuse.Status {
 			log.Print(err)
 			return fuse.EIO
 		}
-		n.Inode().RmChild(name)
+		n.rmChild(name)
 	case (*dirNode):
 		if child.mode&0200 == 0 {
 			return fuse.EPERM
@@ -138,8 +699,8 @@ func (n *dirNode) Rmdir(name string, context *fuse.Context) fuse.Status {
 			log.Print(err)
 			return fuse.EIO
 		}
-		n.Inode().RmChild(name)
-	case (*fileNode):
+		n.rmChild(name)
+	case (*fileNode), (*docNode), (*convertNode):
 		return fuse.ENOTDIR
 	default:
 		return fuse.EINVAL
@@ -149,6 +710,25 @@ func (n *dirNode) Rmdir(name string, context *fuse.Context) fuse.Status {
 	return fuse.OK
 }
 
+// moveFile sets the title of the file with the given id, unless title is
+// empty, and moves it from the folder with id from to the one with id to.
+func moveFile(id, title, from, to string) error {
+	if title != "" {
+		_, err := srv.Files.Patch(id, &drive.File{Title: title}).UpdateViewedDate(false).Do()
+		if err != nil {
+			return err
+		}
+	}
+	if from == to {
+		return nil
+	}
+	_, err := srv.Parents.Insert(id, &drive.ParentReference{Id: to}).Do()
+	if err != nil {
+		return err
+	}
+	return srv.Parents.Delete(id, from).Do()
+}
+
 // n must already be locked for writing
 func (n *dirNode) setTimes(atime, mtime *time.Time) error {
 	if atime.IsZero() && mtime.IsZero() {
@@ -168,11 +748,25 @@ func (n *dirNode) setTimes(atime, mtime *time.Time) error {
 }
 
 func (n *dirNode) Unlink(name string, context *fuse.Context) fuse.Status {
+	if isReadOnly() {
+		return fuse.Status(syscall.EROFS)
+	}
 	n.Lock()
 	defer n.Unlock()
 	if context.Uid != fs.uid || n.mode&0200 == 0 {
 		return fuse.EACCES
 	}
+	code := n.unlink(name)
+	if !code.Ok() {
+		return code
+	}
+	t := time.Now()
+	n.setTimes(&t, &t)
+	return fuse.OK
+}
+
+// n must already be locked for writing
+func (n *dirNode) unlink(name string) fuse.Status {
 	cinode := n.Inode().GetChild(name)
 	if cinode == nil {
 		return fuse.ENOENT
@@ -209,14 +803,42 @@ func (n *dirNode) Unlink(name string, context *fuse.Context) fuse.Status {
 			}
 			child.nlink--
 		}
-		n.Inode().RmChild(name)
+		n.rmChild(name)
+	case (*docNode):
+		child.Lock()
+		defer child.Unlock()
+		child.dir.RLock()
+		defer child.dir.RUnlock()
+		if child.dir.mode&0200 == 0 {
+			return fuse.EPERM
+		}
+		fs.Lock()
+		nlink := len(fs.links[child])
+		fs.Unlock()
+		var err error
+		if nlink == 1 {
+			err = srv.Files.Delete(child.dir.id).Do()
+		} else {
+			err = srv.Children.Delete(n.id, child.dir.id).Do()
+		}
+		if err != nil {
+			log.Print(err)
+			return fuse.EIO
+		}
+		n.rmChild(name)
+	case (*convertNode):
+		child.Lock()
+		child.unlink()
+		child.Unlock()
+		n.rmChild(name)
 	}
-	t := time.Now()
-	n.setTimes(&t, &t)
 	return fuse.OK
 }
 
 func (n *dirNode) Utimens(file fuse.File, atime, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if isReadOnly() {
+		return fuse.Status(syscall.EROFS)
+	}
 	n.Lock()
 	err := n.setTimes(atime, mtime)
 	n.Unlock()
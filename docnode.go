@@ -2,16 +2,19 @@ package main
 
 import (
 	"code.google.com/p/google-api-go-client/drive/v2"
+	"errors"
 	"github.com/hanwen/go-fuse/fuse"
-	"io"
 	"log"
 	"os"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 var mimeToExt = map[string]string{
 	"text/plain":                              ".txt",
+	"text/csv":                                ".csv",
 	"text/html":                               ".html",
 	"application/rtf":                         ".rtf",
 	"application/vnd.oasis.opendocument.text": ".odt",
@@ -26,15 +29,20 @@ var mimeToExt = map[string]string{
 }
 
 type docNode struct {
-	data     []byte
+	content  *content
 	dir      *docDirNode
+	dirty    bool
 	dlurl    string
+	ext      string
 	hasSize  bool
+	ino      uint64
 	mode     uint32
 	name     string
 	size     uint64
-	reader   io.ReadCloser
+	sizeDone chan struct{} // closed when the running size request is done
+	staged   *os.File
 	refcount int
+	unsized  string // the version whose size is only known once downloaded
 	fuse.DefaultFsNode
 	sync.Mutex
 }
@@ -46,52 +54,274 @@ func (n *docNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context)
 	n.Lock()
 	defer n.Unlock()
 	n.dir.RLock()
-	defer n.dir.RUnlock()
-	if !n.hasSize {
-		resp, err := transport.Client().Head(n.dlurl)
-		if err != nil {
-			log.Print(err)
-			return fuse.EIO
+	key := n.versionKey()
+	n.dir.RUnlock()
+	if !n.hasSize && n.unsized != key {
+		if size, ok := exportSizes.get(key); ok {
+			n.size = size
+			n.hasSize = true
+		} else if !*lazyDocSizes {
+			done := n.fetchSize(key)
+			n.Unlock()
+			<-done
+			n.Lock()
+			if !n.hasSize && n.unsized != key {
+				return fuse.EIO
+			}
 		}
-		resp.Body.Close()
-		n.size = uint64(resp.ContentLength)
-		n.hasSize = true
 	}
+	n.dir.RLock()
+	defer n.dir.RUnlock()
+	out.Ino = n.ino
 	out.SetTimes(&n.dir.atime, &n.dir.mtime, nil)
 	out.Owner.Uid = fs.uid
 	out.Owner.Gid = fs.gid
 	out.Mode = n.mode
+	if n.writable() {
+		out.Mode |= 0200
+	}
+	// An unknown size is reported as that of the previous version or 0. The
+	// kernel is notified once the size is known, and reads bypass the page
+	// cache until then (see Open).
 	out.Size = n.size
 	return fuse.OK
 }
 
+// versionKey returns the key identifying the current version of the export.
+// Exports change whenever the document is modified. n and n.dir must already
+// be locked.
+func (n *docNode) versionKey() string {
+	return cacheKey(n.dlurl, n.dir.mtime.String())
+}
+
+// fetchSize requests the size of the version key of the export in the
+// background unless that is already in progress. The returned channel is
+// closed once the request is done. n must already be locked.
+func (n *docNode) fetchSize(key string) chan struct{} {
+	if n.sizeDone != nil {
+		return n.sizeDone
+	}
+	done := make(chan struct{})
+	n.sizeDone = done
+	go func() {
+		sizeSlots <- struct{}{}
+		resp, err := authClient().Head(n.dlurl)
+		<-sizeSlots
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 400 {
+				err = errors.New("failed to get export size: " + resp.Status)
+			}
+		}
+		n.Lock()
+		n.dir.RLock()
+		current := n.versionKey() == key
+		n.dir.RUnlock()
+		switch {
+		case err != nil:
+			log.Print(err)
+		case !current:
+		case resp.ContentLength < 0:
+			// Some exports are generated without announcing their size.
+			n.unsized = key
+		default:
+			n.size = uint64(resp.ContentLength)
+			n.hasSize = true
+			exportSizes.put(key, n.size)
+		}
+		n.sizeDone = nil
+		n.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// setSize records the size of the export once it has been downloaded
+// completely and reports whether it is the size of the current version. n must
+// already be locked.
+func (n *docNode) setSize(key string, size int64) bool {
+	if size < 0 {
+		return false
+	}
+	exportSizes.put(key, uint64(size))
+	n.dir.RLock()
+	defer n.dir.RUnlock()
+	if n.versionKey() != key {
+		return false
+	}
+	n.size = uint64(size)
+	n.hasSize = true
+	return true
+}
+
+// writable reports whether the document is editable and can be converted from
+// the format of n. n.dir must already be locked.
+func (n *docNode) writable() bool {
+	return n.dir.mode&0200 != 0 && importExts[n.ext] != ""
+}
+
 func (n *docNode) Open(flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	if isReadOnly() && flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.Status(syscall.EROFS)
+	}
 	n.Lock()
 	defer n.Unlock()
 	n.dir.Lock()
 	defer n.dir.Unlock()
-	if context.Uid != fs.uid || flags&fuse.O_ANYWRITE != 0 {
+	if context.Uid != fs.uid || (flags&fuse.O_ANYWRITE != 0 && !n.writable()) {
 		return nil, fuse.EPERM
 	}
 	f := new(docFile)
 	f.node = n
 	n.refcount++
-	if n.reader == nil {
-		resp, err := transport.Client().Get(n.dlurl)
-		if err != nil {
+	if flags&fuse.O_ANYWRITE != 0 {
+		if err := n.stage(flags&syscall.O_TRUNC == 0); err != nil {
+			n.refcount--
 			log.Print(err)
 			return nil, fuse.EIO
 		}
-		n.reader = resp.Body
 	}
-	if n.data == nil {
-		n.data = make([]byte, 0)
+	key := n.versionKey()
+	if n.staged == nil && n.content == nil {
+		size := int64(-1)
+		if n.hasSize {
+			size = int64(n.size)
+		}
+		// Exports are generated on the fly, so range requests are not
+		// supported.
+		n.content = newContent(key, n.dlurl, size, false)
+	}
+	if !n.hasSize && n.unsized != key {
+		// The kernel may have been told a wrong size, so it has to ask
+		// again once the size is known.
+		done := n.fetchSize(key)
+		go func() {
+			<-done
+			fs.conn.FileNotify(n.Inode(), 0, 0)
+		}()
+	}
+	if !isReadOnly() {
+		t := time.Now()
+		n.dir.setTimes(&t, nil)
+	}
+	if !n.hasSize {
+		// The kernel would stop reading at the size it was told, so the
+		// export is read directly until its end.
+		return &fuse.WithFlags{File: f, FuseFlags: fuse.FOPEN_DIRECT_IO}, fuse.OK
 	}
-	t := time.Now()
-	n.dir.setTimes(&t, nil)
 	return f, fuse.OK
 }
 
+// stage copies the export into a local file to which writes can be made. If
+// keep is false, the staged file starts out empty instead. n must already be
+// locked.
+func (n *docNode) stage(keep bool) error {
+	if n.staged != nil {
+		return nil
+	}
+	var dlurl string
+	if keep {
+		dlurl = n.dlurl
+	}
+	tmp, size, err := stageFile(n.Id(), dlurl)
+	if err != nil {
+		return err
+	}
+	if n.content != nil {
+		n.content.Close()
+		n.content = nil
+	}
+	n.staged = tmp
+	n.size = uint64(size)
+	n.hasSize = true
+	return nil
+}
+
+// truncate sets the size of the staged content, staging it first if
+// necessary. If no handles are open, it is imported right away, and the
+// resulting metadata of the document are returned. n must already be locked.
+func (n *docNode) truncate(size uint64) (*driveFile, error) {
+	if err := n.stage(size != 0); err != nil {
+		return nil, err
+	}
+	if err := n.staged.Truncate(int64(size)); err != nil {
+		return nil, err
+	}
+	n.size = size
+	n.dirty = true
+	if n.refcount == 0 {
+		return n.upload()
+	}
+	return nil, nil
+}
+
+// upload imports the staged content as a new revision of the document if it
+// was modified and discards it. If the import fails, the staged content is
+// kept, so that the changes aren't lost and are imported again the next time
+// the file is closed. n must already be locked.
+func (n *docNode) upload() (*driveFile, error) {
+	var file *driveFile
+	if n.dirty {
+		var err error
+		file, err = importContent(n.Id(), extToMime(n.ext), n.staged, int64(n.size))
+		if err != nil {
+			log.Println("keeping changes to", n.name, "in", n.staged.Name())
+			return nil, err
+		}
+		// The export of the new revision differs from what was imported.
+		n.hasSize = false
+		n.dirty = false
+	}
+	n.staged.Close()
+	os.Remove(n.staged.Name())
+	n.staged = nil
+	return file, nil
+}
+
+// imported updates the metadata of the document after its content has been
+// imported. The node of the export must not be locked.
+func imported(file *driveFile) {
+	fs.setFile(file)
+	fs.Lock()
+	n := fs.idToNode[file.Id]
+	fs.Unlock()
+	if n != nil {
+		updateNode(n, file)
+	}
+}
+
+func (n *docNode) Truncate(file fuse.File, size uint64, context *fuse.Context) fuse.Status {
+	if isReadOnly() {
+		return fuse.Status(syscall.EROFS)
+	}
+	n.Lock()
+	n.dir.RLock()
+	ok := context.Uid == fs.uid && n.writable()
+	n.dir.RUnlock()
+	if !ok {
+		n.Unlock()
+		return fuse.EPERM
+	}
+	f, err := n.truncate(size)
+	n.Unlock()
+	if err != nil {
+		log.Print(err)
+		return fuse.EIO
+	}
+	if f != nil {
+		imported(f)
+	}
+	return fuse.OK
+}
+
+func (n *docNode) Id() string {
+	return n.dir.id
+}
+
+func (n *docNode) Name() string {
+	return n.name
+}
+
 func (f *docNode) Utimens(file fuse.File, atime, mtime *time.Time, context *fuse.Context) fuse.Status {
 	return f.dir.Utimens(file, atime, mtime, context)
 }
@@ -103,49 +333,75 @@ type docFile struct {
 
 func (f *docFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
 	f.node.Lock()
-	defer f.node.Unlock()
-	if off+int64(len(dest)) >= int64(len(f.node.data)) {
-		for {
-			if f.node.reader == nil {
-				break
-			}
-			diff := off + int64(len(dest)-len(f.node.data))
-			if diff == 0 {
-				break
-			}
-			newData := make([]byte, diff)
-
-			n, err := f.node.reader.Read(newData)
-			if err != nil {
-				if err == io.EOF {
-					f.node.reader.Close()
-					f.node.reader = nil
-				} else {
-					log.Println("read error:", err)
-					return nil, fuse.EIO
-				}
-			}
-			f.node.data = append(f.node.data, newData[:n]...)
-		}
+	if f.node.staged != nil {
+		defer f.node.Unlock()
+		return readStaged(f.node.staged, dest, off)
 	}
-	if off < int64(len(f.node.data)) {
-		n := copy(dest, f.node.data[off:])
-		return &fuse.ReadResultData{dest[:n]}, fuse.OK
+	c := f.node.content
+	f.node.Unlock()
+	// The content is safe for concurrent use, so the node isn't locked while
+	// downloading.
+	n, err := c.ReadAt(dest, off)
+	if err != nil {
+		log.Println("read error:", err)
+		return nil, fuse.EIO
 	}
-	return &fuse.ReadResultData{[]byte{}}, fuse.OK
+	return &fuse.ReadResultData{dest[:n]}, fuse.OK
 }
 
 func (f *docFile) Release() {
+	var file *driveFile
+	var sized bool
 	f.node.Lock()
-	defer f.node.Unlock()
 	f.node.refcount--
 	if f.node.refcount == 0 {
-		if f.node.reader != nil {
-			f.node.reader.Close()
-			f.node.reader = nil
+		if c := f.node.content; c != nil {
+			if !f.node.hasSize {
+				sized = f.node.setSize(c.key, c.length())
+			}
+			c.Close()
+			f.node.content = nil
 		}
-		f.node.data = nil
+		if f.node.staged != nil {
+			var err error
+			if file, err = f.node.upload(); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+	f.node.Unlock()
+	if sized {
+		fs.conn.FileNotify(f.node.Inode(), 0, 0)
+	}
+	if file != nil {
+		imported(file)
+	}
+}
+
+func (f *docFile) Truncate(size uint64) fuse.Status {
+	if isReadOnly() {
+		return fuse.Status(syscall.EROFS)
+	}
+	f.node.Lock()
+	defer f.node.Unlock()
+	if _, err := f.node.truncate(size); err != nil {
+		log.Print(err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+func (f *docFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	if isReadOnly() {
+		return 0, fuse.Status(syscall.EROFS)
 	}
+	f.node.Lock()
+	defer f.node.Unlock()
+	if f.node.staged == nil {
+		return 0, fuse.Status(syscall.EBADF)
+	}
+	f.node.dirty = true
+	return writeStaged(f.node.staged, data, off, &f.node.size)
 }
 
 type docDirNode struct {
@@ -160,12 +416,44 @@ type docDirNode struct {
 }
 
 func newDocDirNode(file *driveFile, ino uint64) *docDirNode {
-	var err error
-
 	n := new(docDirNode)
 	_ = fs.root.Inode().New(true, n)
-	n.id = file.Id
 	n.ino = ino
+	n.setMetadata(file)
+	for _, e := range exports(file) {
+		c := &docNode{dir: n, dlurl: e.url, ext: e.ext, ino: fs.inoFor(n.id + e.ext),
+			mode: fuse.S_IFREG | 0400, name: n.name + e.ext}
+		_ = fs.root.Inode().New(false, c)
+		n.Inode().AddChild(n.name+e.ext, c.Inode())
+	}
+	return n
+}
+
+// newDocFileNode returns a node which presents the document as a single file
+// in its preferred format. Its metadata are kept in a docDirNode which isn't
+// part of the tree. If the document can't be exported, it is presented as a
+// directory instead.
+func newDocFileNode(file *driveFile, ino uint64) Node {
+	e, ok := preferredExport(file)
+	if !ok {
+		return newDocDirNode(file, ino)
+	}
+	dir := new(docDirNode)
+	_ = fs.root.Inode().New(true, dir)
+	dir.ino = ino
+	dir.setMetadata(file)
+	n := &docNode{dir: dir, dlurl: e.url, ext: e.ext, ino: ino,
+		mode: fuse.S_IFREG | 0400, name: dir.name + e.ext}
+	_ = fs.root.Inode().New(false, n)
+	return n
+}
+
+// setMetadata sets the attributes of n from file. n must already be locked
+// for writing or not be visible to other goroutines yet.
+func (n *docDirNode) setMetadata(file *driveFile) {
+	var err error
+
+	n.id = file.Id
 	n.mode = fuse.S_IFDIR | 0500
 	if file.Editable {
 		n.mode |= 0200
@@ -187,15 +475,6 @@ func newDocDirNode(file *driveFile, ino uint64) *docDirNode {
 		n.atime = time.Unix(0, 0)
 		log.Println(n.name, err)
 	}
-	for mime, link := range file.ExportLinks {
-		if ext := mimeToExt[mime]; ext != "" {
-			c := &docNode{dir: n, dlurl: link, mode: fuse.S_IFREG | 0400,
-				name: n.name + ext}
-			_ = fs.root.Inode().New(false, c)
-			n.Inode().AddChild(n.name+ext, c.Inode())
-		}
-	}
-	return n
 }
 
 func (n *docDirNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
@@ -212,11 +491,39 @@ func (n *docDirNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Conte
 	return fuse.OK
 }
 
+func (n *docDirNode) OpenDir(context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if !*lazyDocSizes {
+		// The sizes are likely to be needed for all exports, so request
+		// them at once instead of one stat after another.
+		for _, cinode := range n.Inode().Children() {
+			c := cinode.FsNode().(*docNode)
+			c.Lock()
+			n.RLock()
+			key := c.versionKey()
+			n.RUnlock()
+			if !c.hasSize && c.unsized != key {
+				if _, ok := exportSizes.get(key); !ok {
+					c.fetchSize(key)
+				}
+			}
+			c.Unlock()
+		}
+	}
+	return n.DefaultFsNode.OpenDir(context)
+}
+
+func (n *docDirNode) Id() string {
+	return n.id
+}
+
 func (n *docDirNode) Name() string {
 	return n.name
 }
 
 func (n *docDirNode) Utimens(file fuse.File, atime, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if isReadOnly() {
+		return fuse.Status(syscall.EROFS)
+	}
 	n.Lock()
 	err := n.setTimes(atime, mtime)
 	n.Unlock()
@@ -227,6 +534,20 @@ func (n *docDirNode) Utimens(file fuse.File, atime, mtime *time.Time, context *f
 	return fuse.OK
 }
 
+// rename sets the name of n and its exported files. n must already be locked
+// for writing. The names of the exported files are protected by the lock of n,
+// since docNodes are always locked before their directory.
+func (n *docDirNode) rename(name string) {
+	for cname, cinode := range n.Inode().Children() {
+		c := cinode.FsNode().(*docNode)
+		ext := strings.TrimPrefix(cname, n.name)
+		c.name = name + ext
+		n.Inode().RmChild(cname)
+		n.Inode().AddChild(name+ext, cinode)
+	}
+	n.name = name
+}
+
 // n must already be locked for writing
 func (n *docDirNode) setTimes(atime, mtime *time.Time) error {
 	if atime.IsZero() && mtime.IsZero() {
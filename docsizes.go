@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// maxSizeRequests is the maximum number of export sizes requested at once.
+const maxSizeRequests = 8
+
+// sizeSlots limits the number of running size requests.
+var sizeSlots = make(chan struct{}, maxSizeRequests)
+
+// exportSizes remembers the sizes of exported documents between mounts, since
+// they can only be determined by a request per export.
+var exportSizes = &sizeCache{sizes: make(map[string]uint64)}
+
+// A sizeCache maps versions of exported documents, as identified by cacheKey,
+// to their sizes.
+type sizeCache struct {
+	sizes map[string]uint64
+	dirty bool
+	sync.Mutex
+}
+
+func getSizeFile() string {
+	return filepath.Join(getCacheDir(), "docsizes")
+}
+
+func (c *sizeCache) get(key string) (uint64, bool) {
+	c.Lock()
+	defer c.Unlock()
+	size, ok := c.sizes[key]
+	return size, ok
+}
+
+func (c *sizeCache) put(key string, size uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if old, ok := c.sizes[key]; !ok || old != size {
+		c.sizes[key] = size
+		c.dirty = true
+	}
+}
+
+// load reads the sizes saved by a previous mount.
+func (c *sizeCache) load() error {
+	f, err := os.Open(getSizeFile())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sizes := make(map[string]uint64)
+	if err = gob.NewDecoder(f).Decode(&sizes); err != nil {
+		return err
+	}
+	c.Lock()
+	c.sizes = sizes
+	c.dirty = false
+	c.Unlock()
+	return nil
+}
+
+// save writes the sizes to the cache directory if any have been added since
+// they were loaded.
+func (c *sizeCache) save() error {
+	c.Lock()
+	defer c.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	dir := getCacheDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "docsizes.")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(tmp).Encode(c.sizes)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), getSizeFile())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	c.dirty = false
+	return nil
+}
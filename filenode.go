@@ -3,37 +3,51 @@ package main
 import (
 	"code.google.com/p/google-api-go-client/drive/v2"
 	"github.com/hanwen/go-fuse/fuse"
-	"io"
 	"log"
+	"os"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type fileNode struct {
 	atime    time.Time
-	data     []byte
+	content  *content
+	dirty    bool
 	dlurl    string
+	md5      string
 	mode     uint32
+	modDate  string // the modifiedDate of the content on Drive
 	mtime    time.Time
 	name     string
 	nlink    int
 	id       string
 	ino      uint64
-	reader   io.ReadCloser
 	refcount int
+	session  *uploadSession
 	size     uint64
+	staged   *os.File
 	toDelete bool
 	fuse.DefaultFsNode
 	sync.RWMutex
 }
 
 func newFileNode(file *driveFile, ino uint64) *fileNode {
-	var err error
-
 	n := new(fileNode)
 	_ = fs.root.Inode().New(false, n)
-	n.id = file.Id
 	n.ino = ino
+	n.setMetadata(file)
+	return n
+}
+
+// setMetadata sets the attributes of n from file. n must already be locked
+// for writing or not be visible to other goroutines yet.
+func (n *fileNode) setMetadata(file *driveFile) {
+	var err error
+
+	n.id = file.Id
+	n.md5 = file.Md5Checksum
+	n.modDate = file.ModifiedDate
 	n.name = file.Title
 	n.size = uint64(file.FileSize)
 	n.mode = fuse.S_IFREG | 0400
@@ -57,7 +71,6 @@ func newFileNode(file *driveFile, ino uint64) *fileNode {
 		n.atime = time.Unix(0, 0)
 		log.Println(n.name, err)
 	}
-	return n
 }
 
 func (n *fileNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context) fuse.Status {
@@ -75,40 +88,53 @@ func (n *fileNode) GetAttr(out *fuse.Attr, file fuse.File, context *fuse.Context
 	return fuse.OK
 }
 
+func (n *fileNode) Id() string {
+	return n.id
+}
+
 func (n *fileNode) Name() string {
 	return n.name
 }
 
 func (n *fileNode) Open(flags uint32, context *fuse.Context) (fuse.File, fuse.Status) {
+	if isReadOnly() && flags&fuse.O_ANYWRITE != 0 {
+		return nil, fuse.Status(syscall.EROFS)
+	}
 	n.Lock()
 	defer n.Unlock()
 	if context.Uid != fs.uid || (flags&fuse.O_ANYWRITE != 0 && n.mode&0200 == 0) {
 		return nil, fuse.EPERM
 	}
+	// The access time is set first, so that nothing has to be undone if it
+	// fails.
+	if !isReadOnly() {
+		t := time.Now()
+		err := n.setTimes(&t, nil)
+		if err != nil {
+			log.Print(err)
+			return nil, fuse.EIO
+		}
+	}
 	f := new(file)
 	f.node = n
 	n.refcount++
-	if n.reader == nil {
-		resp, err := transport.Client().Get(n.dlurl)
-		if err != nil {
+	if flags&syscall.O_TRUNC != 0 {
+		if err := n.truncate(0); err != nil {
+			n.refcount--
 			log.Print(err)
 			return nil, fuse.EIO
 		}
-		n.reader = resp.Body
-	}
-	if n.data == nil {
-		n.data = make([]byte, 0)
 	}
-	t := time.Now()
-	err := n.setTimes(&t, nil)
-	if err != nil {
-		log.Print(err)
-		return nil, fuse.EIO
+	if n.staged == nil && n.content == nil {
+		n.content = newContent(n.cacheKey(), n.dlurl, int64(n.size), true)
 	}
 	return f, fuse.OK
 }
 
 func (n *fileNode) Utimens(file fuse.File, atime, mtime *time.Time, context *fuse.Context) fuse.Status {
+	if isReadOnly() {
+		return fuse.Status(syscall.EROFS)
+	}
 	n.Lock()
 	err := n.setTimes(atime, mtime)
 	n.Unlock()
@@ -119,6 +145,160 @@ func (n *fileNode) Utimens(file fuse.File, atime, mtime *time.Time, context *fus
 	return fuse.OK
 }
 
+// cacheKey returns the key of the current content of n in the block cache.
+// n must already be locked.
+func (n *fileNode) cacheKey() string {
+	version := n.md5
+	if version == "" {
+		version = n.mtime.String()
+	}
+	return cacheKey(n.id, version)
+}
+
+// stage copies the content of n into a local file to which writes can be
+// made. If keep is false, the staged file starts out empty instead. n must
+// already be locked for writing.
+func (n *fileNode) stage(keep bool) error {
+	if n.staged != nil {
+		return nil
+	}
+	var dlurl string
+	if keep && n.size != 0 {
+		dlurl = n.dlurl
+	}
+	tmp, _, err := stageFile(n.id, dlurl)
+	if err != nil {
+		return err
+	}
+	if n.content != nil {
+		n.content.Close()
+		n.content = nil
+	}
+	n.staged = tmp
+	return nil
+}
+
+// truncate sets the size of n, zero-extending it if necessary. If no handles
+// are open, the new content is uploaded right away. n must already be locked
+// for writing.
+func (n *fileNode) truncate(size uint64) error {
+	if err := n.stage(size != 0); err != nil {
+		return err
+	}
+	if err := n.staged.Truncate(int64(size)); err != nil {
+		return err
+	}
+	n.size = size
+	n.modified()
+	if n.refcount == 0 {
+		return n.flush()
+	}
+	return nil
+}
+
+// modified marks the staged content of n as changed. n must already be locked
+// for writing.
+func (n *fileNode) modified() {
+	if n.session != nil {
+		// The content of the running upload is about to change.
+		n.session.remove()
+		n.session = nil
+	}
+	n.dirty = true
+	n.mtime = time.Now()
+}
+
+func (n *fileNode) Truncate(file fuse.File, size uint64, context *fuse.Context) fuse.Status {
+	if isReadOnly() {
+		return fuse.Status(syscall.EROFS)
+	}
+	n.Lock()
+	defer n.Unlock()
+	if context.Uid != fs.uid || n.mode&0200 == 0 {
+		return fuse.EPERM
+	}
+	if err := n.truncate(size); err != nil {
+		log.Print(err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+// unstage discards the staged content of n. It must not be called while an
+// upload of the content is pending. n must already be locked for writing.
+func (n *fileNode) unstage() {
+	n.staged.Close()
+	os.Remove(n.staged.Name())
+	n.staged = nil
+}
+
+// flush uploads the staged content of n and discards it. If the upload fails,
+// the staged content is kept, so that the changes aren't lost and are uploaded
+// again the next time the file is closed. n must already be locked for
+// writing.
+func (n *fileNode) flush() error {
+	if err := n.upload(); err != nil {
+		log.Println("keeping changes to", n.name, "in", n.staged.Name())
+		return err
+	}
+	n.unstage()
+	return nil
+}
+
+// upload sends the staged content of n to Drive if it was modified. Large
+// files are sent using a resumable upload session, which is continued on the
+// next call if it fails. n must already be locked for writing.
+func (n *fileNode) upload() error {
+	if !n.dirty {
+		return nil
+	}
+	var (
+		file *driveFile
+		err  error
+	)
+	if n.size > uploadThreshold {
+		if n.session == nil {
+			n.session, err = newUploadSession(n.id, n.md5, n.modDate, n.staged.Name(), int64(n.size))
+			if err != nil {
+				return err
+			}
+		}
+		file, err = n.session.upload(n.staged)
+		if err == errSessionExpired {
+			n.session = nil
+		}
+		if err != nil {
+			return err
+		}
+		n.session = nil
+	} else {
+		file, err = updateContent(n.id, n.staged, int64(n.size))
+		if err != nil {
+			return err
+		}
+	}
+	n.dirty = false
+	n.update(file)
+	return nil
+}
+
+// update sets the metadata of n that changes with its content. n must already
+// be locked for writing.
+func (n *fileNode) update(file *driveFile) {
+	var err error
+
+	n.id = file.Id
+	n.dlurl = file.DownloadUrl
+	n.md5 = file.Md5Checksum
+	n.modDate = file.ModifiedDate
+	n.size = uint64(file.FileSize)
+	n.mtime, err = time.Parse(time.RFC3339Nano, file.ModifiedDate)
+	if err != nil {
+		n.mtime = time.Now()
+		log.Println(n.name, err)
+	}
+}
+
 // n must already be locked for writing
 func (n *fileNode) setTimes(atime, mtime *time.Time) error {
 	if atime.IsZero() && mtime.IsZero() {
@@ -142,38 +322,35 @@ type file struct {
 	node *fileNode
 }
 
-func (f *file) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+func (f *file) Flush() fuse.Status {
 	f.node.Lock()
 	defer f.node.Unlock()
-	if off+int64(len(dest)) >= int64(len(f.node.data)) {
-		for {
-			if f.node.reader == nil {
-				break
-			}
-			diff := off + int64(len(dest)-len(f.node.data))
-			if diff == 0 {
-				break
-			}
-			newData := make([]byte, diff)
+	if err := f.node.upload(); err != nil {
+		log.Print(err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
 
-			n, err := f.node.reader.Read(newData)
-			if err != nil {
-				if err == io.EOF {
-					f.node.reader.Close()
-					f.node.reader = nil
-				} else {
-					log.Println("read error:", err)
-					return nil, fuse.EIO
-				}
-			}
-			f.node.data = append(f.node.data, newData[:n]...)
-		}
+func (f *file) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.node.Lock()
+	defer f.node.Unlock()
+	if f.node.staged != nil {
+		return readStaged(f.node.staged, dest, off)
+	}
+	if f.node.content == nil {
+		f.node.content = newContent(f.node.cacheKey(), f.node.dlurl, int64(f.node.size), true)
 	}
-	if off < int64(len(f.node.data)) {
-		n := copy(dest, f.node.data[off:])
-		return &fuse.ReadResultData{dest[:n]}, fuse.OK
+	c := f.node.content
+	// Don't block other operations on the node while downloading.
+	f.node.Unlock()
+	n, err := c.ReadAt(dest, off)
+	f.node.Lock()
+	if err != nil {
+		log.Println("read error:", err)
+		return nil, fuse.EIO
 	}
-	return &fuse.ReadResultData{[]byte{}}, fuse.OK
+	return &fuse.ReadResultData{dest[:n]}, fuse.OK
 }
 
 func (f *file) Release() {
@@ -181,11 +358,23 @@ func (f *file) Release() {
 	defer f.node.Unlock()
 	f.node.refcount--
 	if f.node.refcount == 0 {
-		if f.node.reader != nil {
-			f.node.reader.Close()
-			f.node.reader = nil
+		if f.node.content != nil {
+			f.node.content.Close()
+			f.node.content = nil
+		}
+		if f.node.staged != nil {
+			if !f.node.toDelete {
+				if err := f.node.flush(); err != nil {
+					log.Print(err)
+				}
+			} else {
+				if f.node.session != nil {
+					f.node.session.remove()
+					f.node.session = nil
+				}
+				f.node.unstage()
+			}
 		}
-		f.node.data = nil
 		if f.node.toDelete {
 			err := srv.Files.Delete(f.node.id).Do()
 			if err != nil {
@@ -194,3 +383,36 @@ func (f *file) Release() {
 		}
 	}
 }
+
+func (f *file) Truncate(size uint64) fuse.Status {
+	if isReadOnly() {
+		return fuse.Status(syscall.EROFS)
+	}
+	f.node.Lock()
+	defer f.node.Unlock()
+	if f.node.mode&0200 == 0 {
+		return fuse.EPERM
+	}
+	if err := f.node.truncate(size); err != nil {
+		log.Print(err)
+		return fuse.EIO
+	}
+	return fuse.OK
+}
+
+func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
+	if isReadOnly() {
+		return 0, fuse.Status(syscall.EROFS)
+	}
+	f.node.Lock()
+	defer f.node.Unlock()
+	if f.node.mode&0200 == 0 {
+		return 0, fuse.EPERM
+	}
+	if err := f.node.stage(true); err != nil {
+		log.Print(err)
+		return 0, fuse.EIO
+	}
+	f.node.modified()
+	return writeStaged(f.node.staged, data, off, &f.node.size)
+}
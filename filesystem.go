@@ -2,25 +2,48 @@ package main
 
 import (
 	"github.com/hanwen/go-fuse/fuse"
+	"hash/fnv"
 	"log"
+	"sync"
 )
 
 type Filesystem struct {
 	root     *dirNode
 	uid      uint32
 	gid      uint32
+	conn     *fuse.FileSystemConnector
+	changeId int64
+	files    map[string]*driveFile
+	idToIno  map[string]uint64
+	inoToId  map[uint64]string
 	idToNode map[string]Node
+	links    map[Node][]link
+	sync.Mutex
+}
+
+// A link is an entry for a node in a directory.
+type link struct {
+	dir   *dirNode
+	name  string
+	title string // the title of the node when it was added
 }
 
 func (fs *Filesystem) OnMount(conn *fuse.FileSystemConnector) {
+	fs.conn = conn
+	if isReadOnly() {
+		// Without authorization, only the cached tree can be shown.
+		if !fs.restoreCachedTree() {
+			log.Fatal("Failed to mount read-only: no cached metadata")
+		}
+		if *pollInterval > 0 {
+			go fs.pollChanges(*pollInterval)
+		}
+		return
+	}
 	rootFile, err := getRoot()
 	if err != nil {
 		log.Fatal("Failed to get root folder metadata:", err)
 	}
-	list, err := listFiles()
-	if err != nil {
-		log.Fatal("Failed to list files:", err)
-	}
 	root := newDirNode(rootFile, 0)
 	fs.root.atime = root.atime
 	fs.root.id = root.id
@@ -28,13 +51,64 @@ func (fs *Filesystem) OnMount(conn *fuse.FileSystemConnector) {
 	fs.root.mtime = root.mtime
 	fs.root.name = root.name
 	fs.root.ino = 1
+	if !*cacheMetadata || !fs.restoreTree() {
+		fs.reset()
+		// Get the change id before listing the files so that no change is
+		// missed.
+		fs.changeId, err = getLargestChangeId()
+		if err != nil {
+			log.Fatal("Failed to get largest change id:", err)
+		}
+		if !*lazy {
+			fs.loadTree()
+		}
+		if *cacheMetadata {
+			if err = fs.saveMetadata(); err != nil {
+				log.Println("Failed to save metadata:", err)
+			}
+		}
+	}
+	go resumeUploads()
+	if *pollInterval > 0 {
+		go fs.pollChanges(*pollInterval)
+	}
+}
+
+// reset empties the tree, leaving only the root.
+func (fs *Filesystem) reset() {
+	for name := range fs.root.Inode().Children() {
+		fs.root.Inode().RmChild(name)
+	}
 	fs.idToNode = make(map[string]Node)
+	fs.idToIno = make(map[string]uint64)
+	fs.inoToId = make(map[uint64]string)
+	fs.files = make(map[string]*driveFile)
+	fs.links = make(map[Node][]link)
 	fs.idToNode[fs.root.id] = fs.root
-	for i, v := range list.Items {
-		n := newNode(&v, uint64(i+2))
-		fs.idToNode[v.Id] = n
+	fs.idToIno[fs.root.id] = 1
+	fs.inoToId[1] = fs.root.id
+}
+
+// loadTree lists all files and builds the whole tree from them.
+func (fs *Filesystem) loadTree() {
+	files, err := listFiles("trashed = false", func(n int) {
+		if n > 1000 {
+			log.Printf("Listed %d files", n)
+		}
+	})
+	if err != nil {
+		log.Fatal("Failed to list files:", err)
+	}
+	fs.buildTree(files)
+}
+
+// buildTree creates the nodes for files and links them into the tree.
+func (fs *Filesystem) buildTree(files []driveFile) {
+	for i := range files {
+		v := &files[i]
+		fs.addNode(v, newNode(v, fs.inoFor(v.Id)))
 	}
-	for _, v := range list.Items {
+	for _, v := range files {
 		n := fs.idToNode[v.Id]
 		// TODO what to do with files having no parents (trash etc.)?
 	parents:
@@ -43,7 +117,7 @@ func (fs *Filesystem) OnMount(conn *fuse.FileSystemConnector) {
 			if parent == nil {
 				continue
 			}
-			parent.Inode().AddChild(n.Name(), n.Inode())
+			parent.addChild(n.Name(), n)
 			switch n := n.(type) {
 			case (*dirNode):
 				// XXX Multiple parents for directories are impossible to
@@ -59,6 +133,56 @@ func (fs *Filesystem) OnMount(conn *fuse.FileSystemConnector) {
 	}
 }
 
+// addNode registers n as the node for file.
+func (fs *Filesystem) addNode(file *driveFile, n Node) {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.idToNode[file.Id] = n
+	fs.files[file.Id] = file
+}
+
+// setFile records the current metadata of a file.
+func (fs *Filesystem) setFile(file *driveFile) {
+	fs.Lock()
+	defer fs.Unlock()
+	fs.files[file.Id] = file
+}
+
+// inoFor returns the inode number of the file with the given id, assigning a
+// new one if it has none yet. Inode numbers are derived from a hash of the id,
+// so that they are the same on every mount; only on collisions the next free
+// number is used.
+func (fs *Filesystem) inoFor(id string) uint64 {
+	fs.Lock()
+	defer fs.Unlock()
+	if ino, ok := fs.idToIno[id]; ok {
+		return ino
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	ino := h.Sum64()
+	for {
+		// 0 is invalid and 1 is reserved for the root.
+		if _, used := fs.inoToId[ino]; !used && ino > 1 {
+			break
+		}
+		ino++
+	}
+	fs.idToIno[id] = ino
+	fs.inoToId[ino] = id
+	return ino
+}
+
+// releaseIno forgets the inode number assigned to id.
+func (fs *Filesystem) releaseIno(id string) {
+	fs.Lock()
+	defer fs.Unlock()
+	if ino, ok := fs.idToIno[id]; ok {
+		delete(fs.inoToId, ino)
+		delete(fs.idToIno, id)
+	}
+}
+
 func (fs *Filesystem) OnUnmount() {
 }
 
@@ -72,20 +196,44 @@ func (fs *Filesystem) String() string {
 
 type Node interface {
 	fuse.FsNode
+	Id() string
 	Name() string
 }
 
-func newNode(f *driveFile, ino uint64) (node Node) {
-	switch f.MimeType {
-	case "application/vnd.google-apps.folder":
-		node = newDirNode(f, ino)
+const folderMime = "application/vnd.google-apps.folder"
+
+func isDocument(mime string) bool {
+	switch mime {
 	case "application/vnd.google-apps.document",
 		"application/vnd.google-apps.spreadsheet",
 		"application/vnd.google-apps.presentation",
 		"application/vnd.google-apps.drawing":
+		return true
+	}
+	return false
+}
+
+func newNode(f *driveFile, ino uint64) (node Node) {
+	switch {
+	case f.MimeType == folderMime:
+		node = newDirNode(f, ino)
+	case isDocument(f.MimeType) && *docFiles:
+		node = newDocFileNode(f, ino)
+	case isDocument(f.MimeType):
 		node = newDocDirNode(f, ino)
 	default:
 		node = newFileNode(f, ino)
 	}
 	return
 }
+
+// sameType reports whether n is of the type newNode would return for f.
+func sameType(n Node, f *driveFile) bool {
+	switch n.(type) {
+	case *dirNode:
+		return f.MimeType == folderMime
+	case *docDirNode, *docNode:
+		return isDocument(f.MimeType)
+	}
+	return f.MimeType != folderMime && !isDocument(f.MimeType)
+}
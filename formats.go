@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// exportFormats maps document types, e.g. "spreadsheet" for
+// application/vnd.google-apps.spreadsheet, to the extensions of the formats
+// in which they are exported, in order of preference. Documents of types which
+// are not listed are exported in all known formats.
+var exportFormats = make(map[string][]string)
+
+// defaultFormats are the preferred export formats of the document types for
+// which none are configured.
+var defaultFormats = map[string]string{
+	"document":     ".docx",
+	"spreadsheet":  ".xlsx",
+	"presentation": ".pptx",
+	"drawing":      ".png",
+}
+
+// importExts maps the extensions of the formats from which documents can be
+// converted to the types of the resulting documents.
+var importExts = map[string]string{
+	".csv":  "spreadsheet",
+	".docx": "document",
+	".html": "document",
+	".ods":  "spreadsheet",
+	".odt":  "document",
+	".pptx": "presentation",
+	".rtf":  "document",
+	".txt":  "document",
+	".xlsx": "spreadsheet",
+}
+
+// An export is a format in which a document can be downloaded.
+type export struct {
+	ext string
+	url string
+}
+
+// docType returns the document type of the given MIME type.
+func docType(mime string) string {
+	return strings.TrimPrefix(mime, "application/vnd.google-apps.")
+}
+
+// extToMime returns the MIME type of the format with the given extension.
+func extToMime(ext string) string {
+	for mime, e := range mimeToExt {
+		if e == ext {
+			return mime
+		}
+	}
+	return ""
+}
+
+// parseFormats parses a list of export formats for document types like
+// "document=docx,odt;spreadsheet=xlsx,csv".
+func parseFormats(s string) (map[string][]string, error) {
+	known := make(map[string]bool)
+	for _, ext := range mimeToExt {
+		known[ext] = true
+	}
+	formats := make(map[string][]string)
+	for _, entry := range strings.Split(s, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("missing formats for %q", entry)
+		}
+		typ := strings.TrimSpace(entry[:i])
+		if _, ok := defaultFormats[typ]; !ok {
+			return nil, fmt.Errorf("unknown document type %q", typ)
+		}
+		var exts []string
+		for _, ext := range strings.Split(entry[i+1:], ",") {
+			ext = "." + strings.TrimPrefix(strings.TrimSpace(ext), ".")
+			if !known[ext] {
+				return nil, fmt.Errorf("unknown format %q", ext)
+			}
+			exts = append(exts, ext)
+		}
+		formats[typ] = exts
+	}
+	return formats, nil
+}
+
+// exports returns the formats in which file is exported, in order of
+// preference.
+func exports(file *driveFile) []export {
+	byExt := make(map[string]string)
+	for mime, link := range file.ExportLinks {
+		if ext := mimeToExt[mime]; ext != "" {
+			byExt[ext] = link
+		}
+	}
+	var list []export
+	if exts, ok := exportFormats[docType(file.MimeType)]; ok {
+		for _, ext := range exts {
+			if link, ok := byExt[ext]; ok {
+				list = append(list, export{ext, link})
+			}
+		}
+		return list
+	}
+	for ext, link := range byExt {
+		list = append(list, export{ext, link})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ext < list[j].ext
+	})
+	return list
+}
+
+// preferredExport returns the format in which file is exported if it is shown
+// as a single file. ok is false if it can't be exported at all.
+func preferredExport(file *driveFile) (e export, ok bool) {
+	list := exports(file)
+	if len(list) == 0 {
+		return export{}, false
+	}
+	if _, configured := exportFormats[docType(file.MimeType)]; !configured {
+		ext := defaultFormats[docType(file.MimeType)]
+		for _, e := range list {
+			if e.ext == ext {
+				return e, true
+			}
+		}
+	}
+	return list[0], true
+}
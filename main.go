@@ -11,8 +11,10 @@ import (
 	"net/http/httputil"
 	"os"
 	"os/signal"
-	"path"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 )
 
 var oauthConf = &oauth.Config{
@@ -30,10 +32,26 @@ var (
 )
 
 var (
-	debugApi  = flag.Bool("debug-api", false, "print Drive API debugging output")
-	debugFuse = flag.Bool("debug-fuse", false, "print FUSE debugging output")
-	doInit    = flag.Bool("init", false, "retrieve a new token")
-	tokenFile = flag.String("tokenfile", getTokenFile(), "path to the token file")
+	accountKey    = flag.String("service-account", "", "authenticate as the service account with the given JSON key file")
+	cacheMetadata = flag.Bool("metadata-cache", true, "keep file metadata on disk between mounts")
+	cacheSize     = flag.Int64("cache-size", 1024, "size limit of the file content cache in MiB (0 to disable)")
+	clientId      = flag.String("client-id", "", "OAuth client ID to use instead of the configured one")
+	clientSecret  = flag.String("client-secret", "", "OAuth client secret belonging to -client-id")
+	configFile    = flag.String("config", getConfigFile(), "path to the config file")
+	convertDir    = flag.String("convert-dir", "", "name of folders in which created files are converted to documents")
+	debugApi      = flag.Bool("debug-api", false, "print Drive API debugging output")
+	debugFuse     = flag.Bool("debug-fuse", false, "print FUSE debugging output")
+	docFiles      = flag.Bool("doc-files", false, "show documents as single files in their preferred format instead of folders")
+	doInit        = flag.Bool("init", false, "retrieve a new token")
+	formats       = flag.String("formats", "", "formats in which documents are exported, e.g. \"document=docx,odt;spreadsheet=xlsx,csv\" (default all)")
+	headless      = flag.Bool("headless", false, "retrieve the token by entering a code on another device instead of with a local browser")
+	impersonate   = flag.String("impersonate", "", "with -service-account, act on behalf of the given user of the domain")
+	lazy          = flag.Bool("lazy", false, "list directories when they are accessed instead of at mount time")
+	lazyDocSizes  = flag.Bool("lazy-doc-sizes", false, "don't request the sizes of exported documents before they are opened")
+	lazyTTL       = flag.Duration("lazy-ttl", time.Minute, "time after which directories are listed again in lazy mode")
+	pollInterval  = flag.Duration("poll", time.Minute, "interval for checking for remote changes (0 to disable)")
+	profile       = flag.String("profile", "", "name of the profile to use, which has its own token, config and cache")
+	tokenFile     = flag.String("tokenfile", getTokenFile(), "path to the token file")
 )
 
 type debugTransport struct {
@@ -69,13 +87,60 @@ func getTokenFile() string {
 			log.Fatalln("Failed to determine token location (neither HOME nor" +
 				" XDG_DATA_HOME are set)")
 		}
-		return home + "/.local/share/drivefs/token"
+		return profileDir(home+"/.local/share/drivefs") + "/token"
+	}
+	return profileDir(dataHome+"/drivefs") + "/token"
+}
+
+func getCacheDir() string {
+	cacheHome := os.Getenv("XDG_CACHE_HOME")
+	if cacheHome == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			log.Fatalln("Failed to determine cache location (neither HOME nor" +
+				" XDG_CACHE_HOME are set)")
+		}
+		return profileDir(home + "/.cache/drivefs")
+	}
+	return profileDir(cacheHome + "/drivefs")
+}
+
+// profileDir returns the subdirectory of the drivefs directory dir in which
+// the files of the profile given by -profile are kept.
+func profileDir(dir string) string {
+	if *profile == "" {
+		return dir
+	}
+	return dir + "/profiles/" + *profile
+}
+
+// applyProfile points the paths which weren't given explicitly to the files
+// of the profile.
+func applyProfile() {
+	if *profile == "" {
+		return
+	}
+	if strings.Contains(*profile, "/") || *profile == "." || *profile == ".." {
+		log.Fatalln("Invalid profile name:", *profile)
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if !set["config"] {
+		*configFile = getConfigFile()
+	}
+	if !set["tokenfile"] {
+		*tokenFile = getTokenFile()
 	}
-	return dataHome + "/drivefs/token"
 }
 
 func connect() {
-	cache := oauth.CacheFile(*tokenFile)
+	if *accountKey != "" {
+		connectServiceAccount()
+		return
+	}
+	cache := tokenCache(*tokenFile)
 	tok, err := cache.Token()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Failed to read token:", err)
@@ -84,29 +149,65 @@ func connect() {
 	} else {
 		transport.Token = tok
 	}
-	srv, err = drive.New(transport.Client())
+	// Refresh tokens only work with the client they were issued to.
+	if id := tok.Extra[tokenClientKey]; id != "" && id != transport.ClientId {
+		fmt.Fprintf(os.Stderr, "The token was issued to the OAuth client %s, but %s is configured.\n", id, transport.ClientId)
+		fmt.Fprintln(os.Stderr, "Configure that client or run drivefs -init again.")
+		os.Exit(1)
+	}
+	// Save refreshed tokens.
+	transport.TokenCache = cache
+	if tok.Expiry.Sub(time.Now()) < refreshMargin {
+		err = refreshToken()
+		if err == errRevoked {
+			fmt.Fprintln(os.Stderr, "Failed to refresh token:", err)
+			if !*cacheMetadata {
+				os.Exit(1)
+			}
+			fmt.Fprintln(os.Stderr, "Mounting read-only from the cached metadata.")
+		} else if err != nil {
+			// The token is refreshed again when it is needed.
+			log.Println("Failed to refresh token:", err)
+		}
+	}
+	srv, err = drive.New(authClient())
+	if err != nil {
+		log.Fatalln("Failed to create drive service:", err)
+	}
+}
+
+// connectServiceAccount authenticates as the service account given by the
+// -service-account flag.
+func connectServiceAccount() {
+	var err error
+	account, err = loadServiceAccount(*accountKey, *impersonate)
+	if err != nil {
+		log.Fatalln("Failed to load service account key:", err)
+	}
+	transport.Token = new(oauth.Token)
+	if err = refreshToken(); err != nil {
+		log.Fatalln("Failed to get token for service account:", err)
+	}
+	srv, err = drive.New(authClient())
 	if err != nil {
 		log.Fatalln("Failed to create drive service:", err)
 	}
 }
 
 func getToken() {
-	var code string
-	if _, err := os.Stat(path.Dir(*tokenFile)); os.IsNotExist(err) {
-		if err = os.MkdirAll(path.Dir(*tokenFile), 0755); err != nil {
-			log.Fatalln("Failed to create cache directory:", err)
-		}
+	var (
+		tok *oauth.Token
+		err error
+	)
+	if *headless {
+		tok, err = newDeviceFlow().token()
+	} else {
+		tok, err = newLoopbackFlow().token()
 	}
-	cache := oauth.CacheFile(*tokenFile)
-	url := transport.AuthCodeURL("")
-	fmt.Println("Visit this URL, log in with your google account and enter the authorization code here:")
-	fmt.Println(url)
-	fmt.Scanln(&code)
-	tok, err := transport.Exchange(code)
 	if err != nil {
-		log.Fatalln("Failed to exchange token:", err)
+		log.Fatalln("Failed to get token:", err)
 	}
-	err = cache.PutToken(tok)
+	err = tokenCache(*tokenFile).PutToken(tok)
 	if err != nil {
 		log.Fatalln("Failed to save token:", err)
 	}
@@ -122,6 +223,8 @@ func main() {
 	transport.Config = oauthConf
 	flag.Usage = usage
 	flag.Parse()
+	applyProfile()
+	configureClient()
 	if *debugApi {
 		transport.Transport = debugTransport{http.DefaultTransport}
 	}
@@ -132,13 +235,22 @@ func main() {
 	if flag.NArg() < 1 {
 		usage()
 	}
+	var err error
+	if exportFormats, err = parseFormats(*formats); err != nil {
+		log.Fatalln("Invalid export formats:", err)
+	}
 	connect()
+	go keepTokenFresh()
+	blocks = newBlockCache(filepath.Join(getCacheDir(), "blocks"), *cacheSize<<20)
+	if err := exportSizes.load(); err != nil && !os.IsNotExist(err) {
+		log.Println("Failed to load export sizes:", err)
+	}
 	fs.root = &dirNode{}
 	fs.uid = uint32(os.Getuid())
 	fs.gid = uint32(os.Getgid())
 	fsc := fuse.NewFileSystemConnector(&fs, nil)
 	ms := fuse.NewMountState(fsc)
-	err := ms.Mount(flag.Arg(0), &fuse.MountOptions{Name: "drivefs"})
+	err = ms.Mount(flag.Arg(0), &fuse.MountOptions{Name: "drivefs"})
 	if err != nil {
 		log.Fatalln("Failed to mount file system:", err)
 	}
@@ -152,4 +264,13 @@ func main() {
 	}()
 	ms.Debug = *debugFuse
 	ms.Loop()
+	convertPending()
+	if *cacheMetadata {
+		if err = fs.saveMetadata(); err != nil {
+			log.Println("Failed to save metadata:", err)
+		}
+	}
+	if err = exportSizes.save(); err != nil {
+		log.Println("Failed to save export sizes:", err)
+	}
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/gob"
+	"github.com/hanwen/go-fuse/fuse"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A metadataCache is the state of the tree as saved between mounts, so that
+// only the changes since the last mount have to be requested.
+type metadataCache struct {
+	ChangeId int64
+	RootId   string
+	Files    []driveFile
+	Inos     map[string]uint64
+	// Complete is false if the cache was saved in lazy mode, in which case
+	// Files only holds the contents of the folders which were listed.
+	Complete bool
+}
+
+func getMetadataFile() string {
+	return filepath.Join(getCacheDir(), "metadata")
+}
+
+func loadMetadata() (*metadataCache, error) {
+	f, err := os.Open(getMetadataFile())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cache := new(metadataCache)
+	err = gob.NewDecoder(f).Decode(cache)
+	return cache, err
+}
+
+// saveMetadata writes the current state of the tree to the metadata file.
+func (fs *Filesystem) saveMetadata() error {
+	fs.Lock()
+	cache := &metadataCache{
+		ChangeId: fs.changeId,
+		RootId:   fs.root.id,
+		Files:    make([]driveFile, 0, len(fs.files)),
+		Inos:     make(map[string]uint64, len(fs.idToIno)),
+		Complete: !*lazy,
+	}
+	for _, f := range fs.files {
+		cache.Files = append(cache.Files, *f)
+	}
+	for id, ino := range fs.idToIno {
+		cache.Inos[id] = ino
+	}
+	fs.Unlock()
+
+	dir := getCacheDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "metadata.")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(tmp).Encode(cache)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), getMetadataFile())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// restoreTree builds the tree from the metadata file and applies the changes
+// made since it was saved. It reports whether this was successful.
+func (fs *Filesystem) restoreTree() bool {
+	cache, err := loadMetadata()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Failed to load metadata:", err)
+		}
+		return false
+	}
+	if cache.RootId != fs.root.id {
+		// The cache belongs to another account.
+		return false
+	}
+	if !cache.Complete && !*lazy {
+		// Only lazy mode lists the folders which are missing.
+		return false
+	}
+	fs.restore(cache)
+	if err = fs.applyChanges(false); err != nil {
+		log.Println("Failed to apply changes to cached metadata:", err)
+		return false
+	}
+	return true
+}
+
+// restoreCachedTree builds the tree from the metadata file alone, for when
+// Drive can't be accessed. It reports whether this was successful.
+func (fs *Filesystem) restoreCachedTree() bool {
+	cache, err := loadMetadata()
+	if err != nil {
+		log.Println("Failed to load metadata:", err)
+		return false
+	}
+	fs.root.id = cache.RootId
+	fs.root.ino = 1
+	fs.root.mode = fuse.S_IFDIR | 0500
+	fs.root.atime = time.Unix(0, 0)
+	fs.root.mtime = time.Unix(0, 0)
+	fs.restore(cache)
+	return true
+}
+
+// restore builds the tree from cache.
+func (fs *Filesystem) restore(cache *metadataCache) {
+	fs.reset()
+	for id, ino := range cache.Inos {
+		fs.idToIno[id] = ino
+		fs.inoToId[ino] = id
+	}
+	fs.changeId = cache.ChangeId
+	fs.buildTree(cache.Files)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"code.google.com/p/goauth2/oauth"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	neturl "net/url"
+	"time"
+)
+
+// account is the service account drivefs authenticates as, if any.
+var account *serviceAccount
+
+// A serviceAccount obtains access tokens by signing JWT assertions with the
+// private key of a service account, so that no user interaction is needed.
+type serviceAccount struct {
+	Email      string `json:"client_email"`
+	PrivateKey string `json:"private_key"`
+	TokenURI   string `json:"token_uri"`
+
+	client  *http.Client
+	key     *rsa.PrivateKey
+	scope   string
+	subject string // the user to impersonate, if any
+}
+
+// loadServiceAccount reads the JSON key file of a service account. If subject
+// is not empty, the service account acts on behalf of that user, which
+// requires domain-wide delegation.
+func loadServiceAccount(path, subject string) (*serviceAccount, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	a := new(serviceAccount)
+	if err = json.Unmarshal(buf, a); err != nil {
+		return nil, err
+	}
+	if a.Email == "" || a.PrivateKey == "" {
+		return nil, errors.New("not a service account key file")
+	}
+	if a.TokenURI == "" {
+		a.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(a.PrivateKey))
+	if block == nil {
+		return nil, errors.New("invalid private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	}
+	var ok bool
+	if a.key, ok = key.(*rsa.PrivateKey); !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	a.client = &http.Client{Transport: transport.Transport}
+	a.scope = transport.Scope
+	a.subject = subject
+	return a, nil
+}
+
+// assertion returns a signed JWT asserting the identity of a.
+func (a *serviceAccount) assertion() (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   a.Email,
+		"scope": a.scope,
+		"aud":   a.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	if a.subject != "" {
+		claims["sub"] = a.subject
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// token exchanges a new assertion for an access token.
+func (a *serviceAccount) token() (*oauth.Token, error) {
+	assertion, err := a.assertion()
+	if err != nil {
+		return nil, err
+	}
+	return postToken(a.client, a.TokenURI, neturl.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+}
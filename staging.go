@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"github.com/hanwen/go-fuse/fuse"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// stageFile creates a local file in the upload directory to which writes to
+// the file with the given id are made until they are uploaded. If dlurl is not
+// empty, the content downloaded from it is copied into the file first. The
+// size of the staged content is returned.
+func stageFile(id, dlurl string) (*os.File, int64, error) {
+	dir := getUploadDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, 0, err
+	}
+	tmp, err := ioutil.TempFile(dir, id+".")
+	if err != nil {
+		return nil, 0, err
+	}
+	var size int64
+	if dlurl != "" {
+		resp, err := authClient().Get(dlurl)
+		if err == nil {
+			// Error responses must not end up as the new content.
+			if resp.StatusCode >= 400 {
+				err = errors.New("failed to download content: " + resp.Status)
+			} else {
+				size, err = io.Copy(tmp, resp.Body)
+			}
+			resp.Body.Close()
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, 0, err
+		}
+	}
+	return tmp, size, nil
+}
+
+// readStaged reads from the staged content f.
+func readStaged(f *os.File, dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	n, err := f.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		log.Println("read error:", err)
+		return nil, fuse.EIO
+	}
+	return &fuse.ReadResultData{dest[:n]}, fuse.OK
+}
+
+// writeStaged writes data to the staged content f at off and extends size if
+// the content has grown.
+func writeStaged(f *os.File, data []byte, off int64, size *uint64) (uint32, fuse.Status) {
+	n, err := f.WriteAt(data, off)
+	if err != nil {
+		log.Println("write error:", err)
+		return uint32(n), fuse.EIO
+	}
+	if end := uint64(off) + uint64(n); end > *size {
+		*size = end
+	}
+	return uint32(n), fuse.OK
+}
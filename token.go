@@ -0,0 +1,227 @@
+package main
+
+import (
+	"code.google.com/p/goauth2/oauth"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// refreshMargin is how long before its expiry the access token is
+	// refreshed.
+	refreshMargin = 5 * time.Minute
+	// refreshRetry is the interval in which failed refreshes are retried.
+	refreshRetry = time.Minute
+)
+
+// tokenClientKey is the key of the extra token field recording the OAuth client
+// the token was issued to.
+const tokenClientKey = "client_id"
+
+var errRevoked = errors.New("the authorization of drivefs has been revoked or has expired, run drivefs -init to renew it")
+
+// readOnly is set while the authorization is revoked. drivefs then keeps
+// serving what it has cached, but rejects all changes. It must be accessed
+// atomically.
+var readOnly int32
+
+// tokenMu protects the token of transport, which is refreshed in the
+// background.
+var tokenMu sync.Mutex
+
+func isReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) != 0
+}
+
+// A tokenCache stores the token in a file like oauth.CacheFile, but replaces
+// the file atomically, so that a crash can't leave a truncated token behind.
+type tokenCache string
+
+func (f tokenCache) Token() (*oauth.Token, error) {
+	return oauth.CacheFile(f).Token()
+}
+
+// PutToken saves tok, recording that it was issued to the configured client
+// unless it records a client already.
+func (f tokenCache) PutToken(tok *oauth.Token) error {
+	if tok.Extra[tokenClientKey] == "" && account == nil {
+		if tok.Extra == nil {
+			tok.Extra = make(map[string]string)
+		}
+		tok.Extra[tokenClientKey] = oauthConf.ClientId
+	}
+	dir := filepath.Dir(string(f))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// Temporary files are only readable by their owner.
+	tmp, err := ioutil.TempFile(dir, filepath.Base(string(f))+".")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(tmp).Encode(tok)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), string(f))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// refreshToken gets a new access token, which is saved to the token file
+// unless a service account is used. If the refresh token has been revoked,
+// errRevoked is returned and drivefs becomes read-only. It becomes writable
+// again once a refresh succeeds.
+func refreshToken() error {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	return refreshLocked()
+}
+
+// refreshLocked is refreshToken for when tokenMu is already locked.
+func refreshLocked() error {
+	var (
+		tok *oauth.Token
+		err error
+	)
+	if account != nil {
+		tok, err = account.token()
+	} else {
+		// oauth.Transport.Refresh doesn't tell a revoked token from a
+		// failure of the token endpoint, so the request is made here.
+		client := &http.Client{Transport: transport.Transport}
+		tok, err = requestToken(client, transport.Config, neturl.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {transport.RefreshToken},
+		})
+		if err == nil {
+			if tok.RefreshToken == "" {
+				tok.RefreshToken = transport.RefreshToken
+			}
+			tok.Extra = transport.Extra
+			if transport.TokenCache != nil {
+				if cerr := transport.TokenCache.PutToken(tok); cerr != nil {
+					log.Println("failed to save token:", cerr)
+				}
+			}
+		}
+	}
+	if rejected(err) {
+		log.Println("failed to refresh token:", err)
+		if atomic.SwapInt32(&readOnly, 1) == 0 {
+			log.Println(errRevoked)
+			log.Println("drivefs is read-only until then")
+		}
+		return errRevoked
+	}
+	if err != nil {
+		return err
+	}
+	transport.Token = tok
+	if atomic.SwapInt32(&readOnly, 0) != 0 {
+		log.Println("authorization renewed, drivefs is writable again")
+	}
+	return nil
+}
+
+// rejected reports whether err means that the authorization has been revoked
+// or has expired, as opposed to e.g. a temporary failure of the token
+// endpoint.
+func rejected(err error) bool {
+	e, ok := err.(*tokenError)
+	return ok && e.Code == "invalid_grant"
+}
+
+// An authTransport authorizes requests with the access token of transport.
+// Unlike oauth.Transport, it only accesses the token while holding tokenMu,
+// since the token is refreshed in the background.
+type authTransport struct{}
+
+func (authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tokenMu.Lock()
+	var err error
+	if transport.Expired() {
+		err = refreshLocked()
+	}
+	access := transport.AccessToken
+	tokenMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// Requests must not be modified by a RoundTripper.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "Bearer "+access)
+	base := transport.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(r)
+}
+
+// authClient returns a client whose requests are authorized with the current
+// access token.
+func authClient() *http.Client {
+	return &http.Client{Transport: authTransport{}}
+}
+
+// tokenExpiry returns when the current access token expires.
+func tokenExpiry() time.Time {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	return transport.Expiry
+}
+
+// keepTokenFresh refreshes the access token shortly before it expires, so
+// that it doesn't have to be refreshed in the middle of a request. While the
+// authorization is revoked, the refresh is retried periodically, using a new
+// token from the token file if there is one, e.g. from running drivefs -init.
+func keepTokenFresh() {
+	for {
+		wait := tokenExpiry().Add(-refreshMargin).Sub(time.Now())
+		if isReadOnly() {
+			wait = refreshRetry
+		}
+		time.Sleep(wait)
+		if isReadOnly() && account == nil {
+			reloadToken()
+		}
+		if err := refreshToken(); err != nil {
+			if err != errRevoked {
+				log.Println("failed to refresh token:", err)
+			}
+			time.Sleep(refreshRetry)
+		}
+	}
+}
+
+// reloadToken uses the token in the token file if its refresh token differs
+// from the current one.
+func reloadToken() {
+	tok, err := tokenCache(*tokenFile).Token()
+	if err != nil {
+		return
+	}
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	if tok.RefreshToken != transport.RefreshToken {
+		transport.Token = tok
+	}
+}
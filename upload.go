@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Files larger than uploadThreshold bytes are uploaded using a resumable
+	// upload instead of a single multipart request.
+	uploadThreshold = 5 << 20
+	// chunkSize is the amount of data sent per request during a resumable
+	// upload. The API requires it to be a multiple of 256 KiB.
+	chunkSize = 32 * 256 << 10
+	// maxRetries is the number of consecutive failed requests after which a
+	// resumable upload is given up. The session is kept, though.
+	maxRetries = 6
+)
+
+var errSessionExpired = errors.New("upload session expired")
+
+// uploadURL is the endpoint at which resumable uploads are started.
+var uploadURL = "https://www.googleapis.com/upload/drive/v2/files/"
+
+// An uploadSession is a resumable upload of new content for an existing file.
+// Sessions are stored in the upload directory until they are complete, so that
+// they can be resumed after drivefs has been restarted.
+type uploadSession struct {
+	Id   string // file id
+	Path string // local file containing the content
+	Size int64
+	URI  string // session URI
+	// The version of the file on Drive the content is based on.
+	Md5          string
+	ModifiedDate string
+}
+
+func getUploadDir() string {
+	return filepath.Join(getCacheDir(), "uploads")
+}
+
+// newUploadSession starts a resumable upload of the content in path, which
+// must be size bytes long, to the file with the given id. md5 and modified are
+// the checksum and modification date of the version of the file the content
+// is based on.
+func newUploadSession(id, md5, modified, path string, size int64) (*uploadSession, error) {
+	s := &uploadSession{Id: id, Path: path, Size: size, Md5: md5, ModifiedDate: modified}
+	if err := s.start(); err != nil {
+		return nil, err
+	}
+	if err := s.save(); err != nil {
+		log.Println("failed to save upload session:", err)
+	}
+	return s, nil
+}
+
+func (s *uploadSession) start() error {
+	url := uploadURL + s.Id + "?uploadType=resumable"
+	req, err := http.NewRequest("PUT", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(s.Size, 10))
+	resp, err := authClient().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return errors.New(resp.Status)
+	}
+	s.URI = resp.Header.Get("Location")
+	if s.URI == "" {
+		return errors.New("no session URI in response")
+	}
+	return nil
+}
+
+// upload sends the content read from r, starting at the offset the server has
+// already received. Failed requests are retried with exponential backoff. If
+// the session has expired, a new one is started.
+func (s *uploadSession) upload(r io.ReaderAt) (*driveFile, error) {
+	var (
+		file  *driveFile
+		off   int64
+		err   error
+		tries int
+	)
+	restarted := false
+	file, off, err = s.query()
+	for file == nil {
+		if err == errSessionExpired && !restarted {
+			restarted = true
+			if err = s.start(); err == nil {
+				s.save()
+				off = 0
+			}
+		}
+		if err != nil {
+			if err == errSessionExpired || tries >= maxRetries {
+				return nil, err
+			}
+			log.Printf("upload of %s failed, retrying: %v", s.Id, err)
+			time.Sleep(time.Second << uint(tries))
+			tries++
+			file, off, err = s.query()
+			continue
+		}
+		file, off, err = s.put(r, off)
+		if err == nil {
+			tries = 0
+		}
+	}
+	s.remove()
+	return file, nil
+}
+
+// put sends the chunk of content starting at off.
+func (s *uploadSession) put(r io.ReaderAt, off int64) (*driveFile, int64, error) {
+	n := s.Size - off
+	if n > chunkSize {
+		n = chunkSize
+	}
+	req, err := http.NewRequest("PUT", s.URI, io.NewSectionReader(r, off, n))
+	if err != nil {
+		return nil, off, err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+n-1, s.Size))
+	return s.do(req, off)
+}
+
+// query asks the server how much of the content it has received.
+func (s *uploadSession) query() (*driveFile, int64, error) {
+	req, err := http.NewRequest("PUT", s.URI, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.ContentLength = 0
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", s.Size))
+	return s.do(req, 0)
+}
+
+// do sends a request of the session. It returns the file metadata if the
+// upload is complete or the offset from which the upload should continue
+// otherwise.
+func (s *uploadSession) do(req *http.Request, off int64) (*driveFile, int64, error) {
+	resp, err := authClient().Do(req)
+	if err != nil {
+		return nil, off, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == 200 || resp.StatusCode == 201:
+		file := new(driveFile)
+		dec := json.NewDecoder(resp.Body)
+		if err = dec.Decode(file); err != nil {
+			return nil, off, err
+		}
+		return file, s.Size, nil
+	case resp.StatusCode == 308:
+		r := resp.Header.Get("Range")
+		if r == "" {
+			return nil, 0, nil
+		}
+		i := strings.LastIndex(r, "-")
+		last, err := strconv.ParseInt(r[i+1:], 10, 64)
+		if err != nil {
+			return nil, off, fmt.Errorf("invalid range %q", r)
+		}
+		return nil, last + 1, nil
+	case resp.StatusCode == 404 || resp.StatusCode == 410:
+		return nil, 0, errSessionExpired
+	}
+	return nil, off, errors.New(resp.Status)
+}
+
+func (s *uploadSession) save() error {
+	dir := getUploadDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, s.Id+".json"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(s)
+}
+
+// remove deletes the stored session state. The content file is left alone.
+func (s *uploadSession) remove() {
+	os.Remove(filepath.Join(getUploadDir(), s.Id+".json"))
+}
+
+// conflicts reports whether the file has been changed on Drive since the
+// content of s was based on it. Sessions which don't record the version are
+// assumed not to conflict.
+func (s *uploadSession) conflicts() (bool, error) {
+	if s.Md5 == "" && s.ModifiedDate == "" {
+		return false, nil
+	}
+	f, err := srv.Files.Get(s.Id).Do()
+	if err != nil {
+		return false, err
+	}
+	// Setting the access time changes the modification date as well, so it
+	// is only compared if there is no checksum.
+	if s.Md5 != "" {
+		return f.Md5Checksum != s.Md5, nil
+	}
+	return f.ModifiedDate != s.ModifiedDate, nil
+}
+
+// resumeUploads completes the uploads which were interrupted when drivefs
+// last exited.
+func resumeUploads() {
+	paths, _ := filepath.Glob(filepath.Join(getUploadDir(), "*.json"))
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		s := new(uploadSession)
+		err = json.NewDecoder(f).Decode(s)
+		f.Close()
+		if err != nil {
+			log.Println("invalid upload session:", p, err)
+			os.Remove(p)
+			continue
+		}
+		resumeUpload(s)
+	}
+}
+
+func resumeUpload(s *uploadSession) {
+	content, err := os.Open(s.Path)
+	if err != nil {
+		log.Println("content of interrupted upload is gone:", err)
+		s.remove()
+		return
+	}
+	defer content.Close()
+	if changed, err := s.conflicts(); err != nil {
+		log.Printf("failed to resume upload of %s: %v", s.Id, err)
+		return
+	} else if changed {
+		log.Printf("%s has been changed on Drive since the upload was interrupted, keeping the local changes in %s", s.Id, s.Path)
+		s.remove()
+		return
+	}
+	log.Println("resuming upload of", s.Id)
+	file, err := s.upload(content)
+	if err != nil {
+		log.Printf("failed to resume upload of %s: %v", s.Id, err)
+		if err == errSessionExpired {
+			log.Println("keeping the local changes in", s.Path)
+			s.remove()
+		}
+		return
+	}
+	os.Remove(s.Path)
+	fs.Lock()
+	n, _ := fs.idToNode[s.Id].(*fileNode)
+	fs.Unlock()
+	if n != nil {
+		n.Lock()
+		if n.staged == nil {
+			n.update(file)
+		}
+		n.Unlock()
+	}
+}
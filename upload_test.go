@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/goauth2/oauth"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A fakeSession is a resumable upload endpoint which stores what it receives.
+type fakeSession struct {
+	*httptest.Server
+	size     int64
+	received []byte
+	sessions int // the number of sessions started
+	expired  bool
+	oldURL   string
+	cacheDir string
+	// accept, if set, limits the number of bytes kept from a chunk.
+	accept func(n int) int
+	// fail, if set, lets a chunk request fail before it is stored.
+	fail func(off int) bool
+	sync.Mutex
+}
+
+var contentRange = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+
+// newFakeSession starts a fakeSession and directs uploads to it. Sessions are
+// saved in a temporary cache directory.
+func newFakeSession(t *testing.T) *fakeSession {
+	dir, err := ioutil.TempDir("", "drivefs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSession{cacheDir: dir, oldURL: uploadURL}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	uploadURL = s.URL + "/files/"
+	os.Setenv("XDG_CACHE_HOME", dir)
+	transport.Token = &oauth.Token{AccessToken: "access"}
+	return s
+}
+
+func (s *fakeSession) close() {
+	s.Close()
+	uploadURL = s.oldURL
+	os.Unsetenv("XDG_CACHE_HOME")
+	os.RemoveAll(s.cacheDir)
+}
+
+func (s *fakeSession) serve(w http.ResponseWriter, req *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.Header.Get("Authorization") != "Bearer access" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if strings.HasPrefix(req.URL.Path, "/files/") {
+		s.size, _ = strconv.ParseInt(req.Header.Get("X-Upload-Content-Length"), 10, 64)
+		s.received = nil
+		s.expired = false
+		s.sessions++
+		w.Header().Set("Location", fmt.Sprintf("%s/session/%d", s.URL, s.sessions))
+		return
+	}
+	if s.expired || req.URL.Path != fmt.Sprintf("/session/%d", s.sessions) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	cr := req.Header.Get("Content-Range")
+	if m := contentRange.FindStringSubmatch(cr); m != nil {
+		first, _ := strconv.Atoi(m[1])
+		switch {
+		case first != len(s.received):
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		case s.fail != nil && s.fail(first):
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		n := len(body)
+		if s.accept != nil {
+			n = s.accept(n)
+		}
+		s.received = append(s.received, body[:n]...)
+	} else if cr != fmt.Sprintf("bytes */%d", s.size) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if int64(len(s.received)) == s.size {
+		json.NewEncoder(w).Encode(&driveFile{Id: "id", FileSize: s.size})
+		return
+	}
+	if len(s.received) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(s.received)-1))
+	}
+	w.WriteHeader(308)
+}
+
+// testUpload starts an upload session of size bytes of content.
+func testUpload(t *testing.T, size int) (*uploadSession, []byte) {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	u, err := newUploadSession("id", "", "", "content", int64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, content
+}
+
+func checkUpload(t *testing.T, s *fakeSession, u *uploadSession, content []byte) {
+	file, err := u.upload(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.FileSize != int64(len(content)) {
+		t.Errorf("file size = %d, want %d", file.FileSize, len(content))
+	}
+	if !bytes.Equal(s.received, content) {
+		t.Errorf("received %d bytes which differ from the content", len(s.received))
+	}
+	if _, err := os.Stat(getUploadDir() + "/id.json"); !os.IsNotExist(err) {
+		t.Error("session wasn't removed:", err)
+	}
+}
+
+func TestUploadSession(t *testing.T) {
+	s := newFakeSession(t)
+	defer s.close()
+	u, content := testUpload(t, 2*chunkSize+chunkSize/2)
+	if _, err := os.Stat(getUploadDir() + "/id.json"); err != nil {
+		t.Error("session wasn't saved:", err)
+	}
+	checkUpload(t, s, u, content)
+	if s.sessions != 1 {
+		t.Errorf("%d sessions started, want 1", s.sessions)
+	}
+}
+
+func TestUploadSessionPartialChunk(t *testing.T) {
+	s := newFakeSession(t)
+	defer s.close()
+	// The server keeps only part of each chunk, so the upload has to
+	// continue from the offset given in the Range header.
+	s.accept = func(n int) int {
+		if n > 1000 {
+			return n - 1000
+		}
+		return n
+	}
+	u, content := testUpload(t, chunkSize+chunkSize/2)
+	checkUpload(t, s, u, content)
+}
+
+func TestUploadSessionRetry(t *testing.T) {
+	s := newFakeSession(t)
+	defer s.close()
+	failed := false
+	s.fail = func(off int) bool {
+		if off == chunkSize && !failed {
+			failed = true
+			return true
+		}
+		return false
+	}
+	u, content := testUpload(t, 2*chunkSize)
+	checkUpload(t, s, u, content)
+	if !failed {
+		t.Error("no request failed")
+	}
+	if s.sessions != 1 {
+		t.Errorf("%d sessions started, want 1", s.sessions)
+	}
+}
+
+func TestUploadSessionResume(t *testing.T) {
+	s := newFakeSession(t)
+	defer s.close()
+	u, content := testUpload(t, chunkSize+chunkSize/2)
+	// The first chunk was sent before drivefs exited.
+	s.received = append([]byte(nil), content[:chunkSize]...)
+	sent := 0
+	s.accept = func(n int) int {
+		sent += n
+		return n
+	}
+	checkUpload(t, s, u, content)
+	if sent != chunkSize/2 {
+		t.Errorf("sent %d bytes, want %d", sent, chunkSize/2)
+	}
+}
+
+func TestUploadSessionExpired(t *testing.T) {
+	s := newFakeSession(t)
+	defer s.close()
+	u, content := testUpload(t, chunkSize+chunkSize/2)
+	s.received = append([]byte(nil), content[:chunkSize]...)
+	s.expired = true
+	checkUpload(t, s, u, content)
+	if s.sessions != 2 {
+		t.Errorf("%d sessions started, want 2", s.sessions)
+	}
+}
+
+func TestUploadSessionExpiredTwice(t *testing.T) {
+	s := newFakeSession(t)
+	defer s.close()
+	u, content := testUpload(t, chunkSize)
+	// Every new session expires right away.
+	s.fail = func(off int) bool {
+		s.expired = true
+		return true
+	}
+	s.expired = true
+	if _, err := u.upload(bytes.NewReader(content)); err != errSessionExpired {
+		t.Errorf("got error %v, want %v", err, errSessionExpired)
+	}
+}